@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/seansitter/gogw/httperr"
+	gwlog "github.com/seansitter/gogw/log"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+)
+
+// An api key from the key store. Only the sha256 of the key is stored, never the key itself
+type APIKey struct {
+	ID        string                 `json:"id"`
+	Hash      string                 `json:"hash"`      // hex encoded sha256 of the key
+	Owner     string                 `json:"owner"`     // the principal the key was issued to, the sub claim
+	Endpoints []string               `json:"endpoints"` // the endpoints the key may call, all when empty
+	Metadata  map[string]interface{} `json:"metadata"`  // additional claims about the owner, ie scope
+}
+
+// Whether the key may call the endpoint
+func (key *APIKey) AllowsEndpoint(name string) bool {
+	if len(key.Endpoints) == 0 {
+		return true
+	}
+	for _, ep := range key.Endpoints {
+		if ep == name {
+			return true
+		}
+	}
+	return false
+}
+
+// the claims of the key's owner
+func (key *APIKey) claims() Claims {
+	claims := make(Claims)
+	for k, v := range key.Metadata {
+		claims[k] = v
+	}
+	claims["sub"] = key.Owner
+	claims["key_id"] = key.ID
+	return claims
+}
+
+// An authentication artifact which restricts the endpoints the principal may call, ie an api key
+type EndpointRestricted interface {
+	AllowsEndpoint(name string) bool
+}
+
+// Returns the hex encoded sha256 of an api key, as it is stored in the key store
+func HashAPIKey(key string) string {
+	return hashToken(key)
+}
+
+// Api keys by the hash of the key
+type APIKeyStore struct {
+	keys map[string]*APIKey
+}
+
+// Parses a key store from json, ie {"keys": [{"id": "k1", "hash": "<sha256>", "owner": "billing"}]}
+func ParseAPIKeyStore(ctnt []byte) (*APIKeyStore, error) {
+	var store struct {
+		Keys []*APIKey `json:"keys"`
+	}
+	if err := json.Unmarshal(ctnt, &store); nil != err {
+		return nil, errors.New(fmt.Sprintf("failed to parse api key store: %v", err))
+	}
+
+	keys := make(map[string]*APIKey)
+	for _, key := range store.Keys {
+		hash := strings.ToLower(key.Hash)
+		if _, err := hex.DecodeString(hash); nil != err || len(hash) != sha256.Size*2 {
+			return nil, errors.New(fmt.Sprintf("api key: '%v' hash is not a hex encoded sha256", key.ID))
+		}
+		if key.Owner == "" {
+			return nil, errors.New(fmt.Sprintf("api key: '%v' has no owner", key.ID))
+		}
+		if _, ok := keys[hash]; ok {
+			return nil, errors.New(fmt.Sprintf("api key: '%v' is a duplicate", key.ID))
+		}
+		keys[hash] = key
+	}
+
+	log.Infof("loaded %v api keys", len(keys))
+	return &APIKeyStore{keys}, nil
+}
+
+// Returns the stored key matching the presented key, nil when there is none
+func (store *APIKeyStore) Lookup(key string) *APIKey {
+	return store.keys[HashAPIKey(key)]
+}
+
+type APIKeyAuthenticator struct {
+	store *APIKeyStore
+}
+
+func NewAPIKeyAuthenticator(store *APIKeyStore) *APIKeyAuthenticator {
+	return &APIKeyAuthenticator{store}
+}
+
+// Authenticates an api key, the artifact of a successful result is the *APIKey
+func (authenticator *APIKeyAuthenticator) Authenticate(creds interface{}) (*AuthResult, error) {
+	key, _ := creds.(string)
+	if key == "" {
+		return &AuthResult{false, nil, nil}, AuthError{"no api key"}
+	}
+
+	apiKey := authenticator.store.Lookup(key)
+	if nil == apiKey {
+		return &AuthResult{false, nil, nil}, AuthError{"unknown api key"}
+	}
+
+	return &AuthResult{true, apiKey, apiKey.claims()}, nil
+}
+
+// Returns a function which a stagehandler uses as an adapter to an api key authenticator. The key is taken
+// from the header, or else the query param when one is set. It is removed from the request, so that it isn't
+// forwarded to the endpoint
+func NewAPIKeyAuthHandler(authenticator Authenticator, header string, queryParam string) (AuthHandler, error) {
+	if header == "" && queryParam == "" {
+		return nil, errors.New("api key auth needs a header or query param to take the key from")
+	}
+
+	authHandlerFunc := func(r *http.Request) (*AuthResult, *httperr.Error) {
+		var key string
+		if header != "" {
+			key = r.Header.Get(header)
+			r.Header.Del(header)
+		}
+		if queryParam != "" {
+			query := r.URL.Query()
+			if _, ok := query[queryParam]; ok {
+				if key == "" {
+					key = query.Get(queryParam)
+				}
+				query.Del(queryParam)
+				r.URL.RawQuery = query.Encode()
+			}
+		}
+
+		if key == "" {
+			return nil, NoCredentials
+		}
+
+		result, err := authenticator.Authenticate(key)
+		if !result.Success || nil != err {
+			if nil != err {
+				gwlog.FromContext(r.Context()).Info(err)
+			}
+			// returning nil for error means authentication failed and will cause a 403 forbidden to client
+			return nil, nil
+		}
+
+		return result, nil
+	}
+
+	return authHandlerFunc, nil
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counters of a cache of authentication results
+type CacheStats struct {
+	Hits          uint64
+	Misses        uint64
+	Invalidations uint64 // entries found but no longer trusted, ie their key was rotated out. counted as misses
+	Size          int    // entries currently cached, some of which may have expired
+}
+
+// A bounded cache of authentication results by token hash. Entries expire at their own time, and the
+// least recently used entry is evicted when the cache is full
+type tokenCache struct {
+	hits          uint64 // atomic
+	misses        uint64 // atomic
+	invalidations uint64 // atomic
+	size          int
+	entries       map[string]*list.Element
+	lru           *list.List // most recently used at the front
+	lock          sync.Mutex
+}
+
+type tokenCacheEntry struct {
+	hash    string
+	value   interface{}
+	expires time.Time
+}
+
+func newTokenCache(size int) *tokenCache {
+	return &tokenCache{size: size, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+// the sha256 of a token, so that tokens themselves are not held in memory
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the cached value for the token hash, if it has not expired
+func (c *tokenCache) Get(hash string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.entries[hash]
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+
+	entry := elem.Value.(*tokenCacheEntry)
+	if !time.Now().Before(entry.expires) {
+		c.remove(elem)
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	atomic.AddUint64(&c.hits, 1)
+	return entry.value, true
+}
+
+// Evicts an entry which was returned by Get but can no longer be trusted, ie its key was rotated out
+func (c *tokenCache) Invalidate(hash string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.entries[hash]; ok {
+		c.remove(elem)
+	}
+	atomic.AddUint64(&c.invalidations, 1)
+}
+
+func (c *tokenCache) Stats() CacheStats {
+	c.lock.Lock()
+	size := c.lru.Len()
+	c.lock.Unlock()
+
+	invalidations := atomic.LoadUint64(&c.invalidations)
+	return CacheStats{
+		Hits:          atomic.LoadUint64(&c.hits) - invalidations,
+		Misses:        atomic.LoadUint64(&c.misses) + invalidations,
+		Invalidations: invalidations,
+		Size:          size,
+	}
+}
+
+// Caches the value for the token hash until it expires
+func (c *tokenCache) Put(hash string, value interface{}, expires time.Time) {
+	if c.size <= 0 || !time.Now().Before(expires) {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.entries[hash]; ok {
+		elem.Value = &tokenCacheEntry{hash, value, expires}
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	for c.lru.Len() >= c.size {
+		c.remove(c.lru.Back())
+	}
+	c.entries[hash] = c.lru.PushFront(&tokenCacheEntry{hash, value, expires})
+}
+
+func (c *tokenCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*tokenCacheEntry).hash)
+}
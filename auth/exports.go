@@ -5,9 +5,17 @@ import (
 	"net/http"
 )
 
-// An AuthHandler is an adapter function which takes a request and returns a bool for
-// successful authentication and an optional http error
-type AuthHandler func(r *http.Request) (bool, *httperr.Error)
+// An AuthHandler is an adapter function which takes a request and returns the result of
+// authentication and an optional http error. A nil or unsuccessful result means authentication failed
+type AuthHandler func(r *http.Request) (*AuthResult, *httperr.Error)
+
+// Returned by an AuthHandler when the request carries no credentials for its scheme, so that the
+// next scheme of an endpoint is tried. When no scheme has credentials the client gets a 401. Its own value,
+// rather than a pointer to httperr.UnAuthorized, so that an actual auth failure is never taken for it
+var NoCredentials = &httperr.Error{Code: 401, Message: "unauthorized"}
+
+// Claims about the authenticated principal, ie the claims of a jwt token
+type Claims map[string]interface{}
 
 type AuthError struct {
 	msg string
@@ -17,9 +25,21 @@ func (err AuthError) Error() string {
 	return err.msg
 }
 
+// Returned when a token couldn't be checked because a service the authenticator relies on failed, ie the
+// identity provider is down or timed out. The token was neither accepted nor rejected, so the client gets a
+// 503 rather than a 403, and the result is not cached
+type UnavailableError struct {
+	Err error
+}
+
+func (err UnavailableError) Error() string {
+	return err.Err.Error()
+}
+
 type AuthResult struct {
 	Success  bool
 	Artifact interface{} // optional artiface of authentication (ie, jwt token)
+	Claims   Claims      // optional claims about the authenticated principal
 }
 
 type Authenticator interface {
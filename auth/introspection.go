@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Settings for an oauth2 token introspection endpoint (rfc 7662)
+type IntrospectionConfig struct {
+	URL          string
+	ClientID     string
+	ClientSecret string
+	Timeout      time.Duration
+	CacheSize    int           // the number of results cached, 0 disables caching
+	MaxCacheTTL  time.Duration // the longest an active result is cached, regardless of the token's exp
+	InactiveTTL  time.Duration // how long an inactive result is cached
+}
+
+// Authenticates opaque tokens by asking the identity provider's introspection endpoint about them. Results
+// are cached by token hash, active tokens until their expiry and inactive ones for a while
+type IntrospectionAuthenticator struct {
+	config IntrospectionConfig
+	client *http.Client
+	cache  *tokenCache
+}
+
+func NewIntrospectionAuthenticator(config IntrospectionConfig) (*IntrospectionAuthenticator, error) {
+	if config.URL == "" {
+		return nil, errors.New("no url set for token introspection")
+	}
+
+	return &IntrospectionAuthenticator{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+		cache:  newTokenCache(config.CacheSize),
+	}, nil
+}
+
+// Returns a function which a stagehandler uses as an adapter to an introspection authenticator, run on the
+// worker pool since introspection calls out to the identity provider
+func NewPooledIntrospectionAuthHandler(pool *WorkerPool, config IntrospectionConfig) (AuthHandler, error) {
+	authenticator, err := NewIntrospectionAuthenticator(config)
+	if nil != err {
+		return nil, errors.New(fmt.Sprintf("failed to instantiate authenticator: %s", err))
+	}
+
+	return newBearerAuthHandler(NewPooledAuthenticator(pool, authenticator), func(string) bool { return true })
+}
+
+// Returns the cached result for the token, when there is one
+func (authenticator *IntrospectionAuthenticator) FromCache(creds interface{}) (AuthReturn, bool) {
+	token, err := splitToken(creds.(string))
+	if nil != err {
+		return AuthReturn{}, false
+	}
+
+	cached, ok := authenticator.cache.Get(hashToken(token))
+	if !ok {
+		return AuthReturn{}, false
+	}
+	return introspectionResult(cached.(Claims)), true
+}
+
+func (authenticator *IntrospectionAuthenticator) CacheStats() CacheStats {
+	return authenticator.cache.Stats()
+}
+
+func (authenticator *IntrospectionAuthenticator) Authenticate(creds interface{}) (*AuthResult, error) {
+	if ret, ok := authenticator.FromCache(creds); ok {
+		return ret.AuthResult, ret.AuthError
+	}
+	return authenticator.introspectToken(creds)
+}
+
+func (authenticator *IntrospectionAuthenticator) Uncached() Authenticator {
+	return AuthenticatorFunc(authenticator.introspectToken)
+}
+
+// introspects the token and caches the result. A failure to get an answer from the introspection endpoint
+// is not cached, and is returned as an UnavailableError
+func (authenticator *IntrospectionAuthenticator) introspectToken(creds interface{}) (*AuthResult, error) {
+	token, err := splitToken(creds.(string))
+	if nil != err {
+		return &AuthResult{false, nil, nil}, AuthError{err.Error()}
+	}
+
+	claims, expires, err := authenticator.introspect(token)
+	if nil != err {
+		return &AuthResult{false, nil, nil}, UnavailableError{err}
+	}
+	authenticator.cache.Put(hashToken(token), claims, expires)
+
+	ret := introspectionResult(claims)
+	return ret.AuthResult, ret.AuthError
+}
+
+// the result for an introspected token, nil claims are an inactive token
+func introspectionResult(claims Claims) AuthReturn {
+	if nil == claims {
+		return AuthReturn{&AuthResult{false, nil, nil}, AuthError{"token is not active"}}
+	}
+	return AuthReturn{&AuthResult{true, nil, claims}, nil}
+}
+
+// Asks the introspection endpoint about the token, returning its claims, or nil claims when it is inactive,
+// along with how long the result may be cached
+func (authenticator *IntrospectionAuthenticator) introspect(token string) (Claims, time.Time, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest(http.MethodPost, authenticator.config.URL, strings.NewReader(form.Encode()))
+	if nil != err {
+		return nil, time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if authenticator.config.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(authenticator.config.ClientID), url.QueryEscape(authenticator.config.ClientSecret))
+	}
+
+	resp, err := authenticator.client.Do(req)
+	if nil != err {
+		return nil, time.Time{}, errors.New(fmt.Sprintf("token introspection failed: %v", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, errors.New(fmt.Sprintf("unexpected status: %v from token introspection", resp.StatusCode))
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if nil != err {
+		return nil, time.Time{}, err
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(body, &claims); nil != err {
+		return nil, time.Time{}, errors.New(fmt.Sprintf("failed to parse token introspection response: %v", err))
+	}
+
+	now := time.Now()
+	inactiveUntil := now.Add(authenticator.config.InactiveTTL)
+
+	if active, _ := claims["active"].(bool); !active {
+		return nil, inactiveUntil, nil
+	}
+	delete(claims, "active")
+
+	// active tokens are cached until they expire, and no longer than the max ttl
+	expires := now.Add(authenticator.config.MaxCacheTTL)
+	if exp, ok := claims["exp"].(float64); ok {
+		tokenExpires := time.Unix(int64(exp), 0)
+		if !tokenExpires.After(now) {
+			return nil, inactiveUntil, nil
+		}
+		if tokenExpires.Before(expires) {
+			expires = tokenExpires
+		}
+	}
+
+	return claims, expires, nil
+}
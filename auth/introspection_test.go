@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A stand in for an identity provider's introspection endpoint, which knows a single active token
+type introspectionServer struct {
+	*httptest.Server
+	activeToken string
+	status      int // of the responses, 200 unless set
+	calls       int
+	lock        sync.Mutex
+}
+
+func newIntrospectionServer(activeToken string) *introspectionServer {
+	s := &introspectionServer{activeToken: activeToken, status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.calls++
+
+		if s.status != http.StatusOK {
+			w.WriteHeader(s.status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.PostFormValue("token") != s.activeToken {
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": false})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"active": true,
+			"sub":    "user-1",
+			"exp":    time.Now().Add(time.Hour).Unix(),
+		})
+	}))
+	return s
+}
+
+func (s *introspectionServer) setStatus(status int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status = status
+}
+
+func (s *introspectionServer) callCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.calls
+}
+
+// the pooled handler for the introspection endpoint, along with its pool for the caller to stop
+func newTestIntrospectionAuthHandler(t *testing.T, url string) (AuthHandler, *WorkerPool) {
+	pool := NewWorkerPool(2, 2, time.Second)
+	handler, err := NewPooledIntrospectionAuthHandler(pool, IntrospectionConfig{
+		URL:         url,
+		Timeout:     time.Second,
+		CacheSize:   10,
+		MaxCacheTTL: time.Minute,
+		InactiveTTL: time.Minute,
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	return handler, pool
+}
+
+func bearerRequest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestIntrospectionActiveToken(t *testing.T) {
+	s := newIntrospectionServer("good-token")
+	defer s.Close()
+	handler, pool := newTestIntrospectionAuthHandler(t, s.URL)
+	defer pool.Stop()
+
+	result, httpErr := handler(bearerRequest("good-token"))
+	if nil != httpErr || nil == result || !result.Success {
+		t.Fatalf("expected the active token to authenticate, got: %v, %v", result, httpErr)
+	}
+	if sub := result.Claims["sub"]; sub != "user-1" {
+		t.Errorf("expected the introspected claims, got sub: %v", sub)
+	}
+
+	// the result is cached
+	handler(bearerRequest("good-token"))
+	if calls := s.callCount(); calls != 1 {
+		t.Errorf("expected the cached result to be used, got %v introspection calls", calls)
+	}
+}
+
+func TestIntrospectionInactiveToken(t *testing.T) {
+	s := newIntrospectionServer("good-token")
+	defer s.Close()
+	handler, pool := newTestIntrospectionAuthHandler(t, s.URL)
+	defer pool.Stop()
+
+	// a rejected token is a failed authentication, which the gateway answers with a 403
+	result, httpErr := handler(bearerRequest("revoked-token"))
+	if nil != httpErr || (nil != result && result.Success) {
+		t.Fatalf("expected the inactive token to fail authentication, got: %v, %v", result, httpErr)
+	}
+}
+
+func TestIntrospectionServerErrorIsUnavailable(t *testing.T) {
+	s := newIntrospectionServer("good-token")
+	defer s.Close()
+	handler, pool := newTestIntrospectionAuthHandler(t, s.URL)
+	defer pool.Stop()
+	s.setStatus(http.StatusInternalServerError)
+
+	_, httpErr := handler(bearerRequest("good-token"))
+	if nil == httpErr || httpErr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected a 503 when the identity provider fails, got: %v", httpErr)
+	}
+
+	// the failure isn't cached, once the identity provider recovers the token is accepted
+	s.setStatus(http.StatusOK)
+	result, httpErr := handler(bearerRequest("good-token"))
+	if nil != httpErr || nil == result || !result.Success {
+		t.Fatalf("expected the token to authenticate once the identity provider recovered, got: %v, %v", result, httpErr)
+	}
+	if calls := s.callCount(); calls != 2 {
+		t.Errorf("expected the token to be introspected again, got %v introspection calls", calls)
+	}
+}
+
+func TestIntrospectionUnreachableIsUnavailable(t *testing.T) {
+	s := newIntrospectionServer("good-token")
+	url := s.URL
+	s.Close() // the identity provider is down
+
+	authenticator, err := NewIntrospectionAuthenticator(IntrospectionConfig{URL: url, Timeout: time.Second, CacheSize: 10})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	_, err = authenticator.Authenticate("Bearer good-token")
+	if _, ok := err.(UnavailableError); !ok {
+		t.Fatalf("expected an UnavailableError when the identity provider is down, got: %v", err)
+	}
+	if httpErr := poolError(err); nil == httpErr || httpErr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the error to be a 503, got: %v", httpErr)
+	}
+	if stats := authenticator.CacheStats(); stats.Size != 0 {
+		t.Errorf("expected nothing cached, got: %v entries", stats.Size)
+	}
+}
@@ -1,170 +1,310 @@
 package auth
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/seansitter/gogw/httperr"
-	log "github.com/sirupsen/logrus"
+	gwlog "github.com/seansitter/gogw/log"
 	"net/http"
 	"strings"
+	"time"
 )
 
 // Returns a function which a stagehandler uses as an adapter to an authenticator.
-// An AuthHandler takes an HTTP Request and returns an bool to indicate auth success
+// An AuthHandler takes an HTTP Request and returns the auth result, with the token claims on success,
 // and an optional http error (ie 401, 403)
-func NewJWTAuthHandler(key interface{}) (AuthHandler, error) {
-	authenticator, err := NewJWTAuthenticator(key) // the component that actually authenticates the token
+func NewJWTAuthHandler(keys KeyProvider, validation JWTValidation) (AuthHandler, error) {
+	authenticator, err := NewJWTAuthenticator(keys, validation) // the component that actually authenticates the token
 	if nil != err {
 		return nil, errors.New(fmt.Sprintf("failed to instantiate authenticator: %s", err))
 	}
 
-	return newJWTAuthHandler(authenticator, key)
+	return newBearerAuthHandler(authenticator, isJWT)
 }
 
 // Returns a function which a stagehandler uses as an adapter to an authenticator with pooled workers for
 // computationally expensive token validation
-// An AuthHandler takes an HTTP Request and returns an bool to indicate auth success
+// An AuthHandler takes an HTTP Request and returns the auth result, with the token claims on success,
 // and an optional http error (ie 401, 403)
-func NewPooledJWTAuthHandler(numWorkers int, key interface{}) (AuthHandler, error) {
-	authenticator, err := NewPooledJWTAuthenticator(numWorkers, key) // the component that actually authenticates the token
+func NewPooledJWTAuthHandler(pool *WorkerPool, keys KeyProvider, validation JWTValidation) (AuthHandler, error) {
+	authenticator, err := NewPooledJWTAuthenticator(pool, keys, validation) // the component that actually authenticates the token
 	if nil != err {
 		return nil, errors.New(fmt.Sprintf("failed to instantiate authenticator: %s", err))
 	}
 
-	return newJWTAuthHandler(authenticator, key)
+	return newBearerAuthHandler(authenticator, isJWT)
 }
 
-func newJWTAuthHandler(authenticator Authenticator, key interface{}) (AuthHandler, error) {
-	authHandlerFunc := func(r *http.Request) (bool, *httperr.Error) {
-		authHeader := r.Header["Authorization"]
-		if nil == authHeader {
-			return false, &httperr.UnAuthorized
+// Returns an AuthHandler which authenticates the request's bearer token, when accepts is true of it
+func newBearerAuthHandler(authenticator Authenticator, accepts func(token string) bool) (AuthHandler, error) {
+	authHandlerFunc := func(r *http.Request) (*AuthResult, *httperr.Error) {
+		// other schemes, ie basic, are left to the endpoint's other auth handlers
+		bearerToken := findBearerToken(r.Header["Authorization"])
+		if bearerToken == "" {
+			return nil, NoCredentials
+		}
+		if token, err := splitToken(bearerToken); nil == err && !accepts(token) {
+			return nil, NoCredentials
 		}
 
-		// TODO: this should find the bearer auth header if there are multiple
-		bearerToken := authHeader[0]
-		result, err := authenticator.Authenticate(bearerToken)
+		var result *AuthResult
+		var err error
+		if ctxAuthenticator, ok := authenticator.(ContextAuthenticator); ok {
+			result, err = ctxAuthenticator.AuthenticateContext(r.Context(), bearerToken)
+		} else {
+			result, err = authenticator.Authenticate(bearerToken)
+		}
+
+		// the token was never checked, ie the worker pool is saturated or the identity provider is down
+		if httpErr := poolError(err); nil != httpErr {
+			gwlog.FromContext(r.Context()).Info(err)
+			return nil, httpErr
+		}
 
-		if !result.Success || nil != err {
+		if nil == result || !result.Success || nil != err {
 			if nil != err {
-				log.Info(err)
+				gwlog.FromContext(r.Context()).Info(err)
 			}
 			// returning nil for error means authentication failed and will cause a 403 forbidden to client
-			return false, nil
+			return nil, nil
 		}
 
-		return true, nil
+		return result, nil
 	}
 
 	return authHandlerFunc, nil
 }
 
+// the http error for an authentication which failed to run on the worker pool, or couldn't reach a service
+// it relies on, nil for any other error
+func poolError(err error) *httperr.Error {
+	switch err {
+	case ErrPoolBusy, ErrPoolStopped:
+		return &httperr.TooBusy
+	case context.Canceled, context.DeadlineExceeded:
+		return &httperr.ClientClosedRequest
+	}
+	if _, ok := err.(UnavailableError); ok {
+		return &httperr.Unavailable
+	}
+	return nil
+}
+
+// Validation of a token beyond its signature
+type JWTValidation struct {
+	Algorithms     []string      // allowed signing algorithms, ie RS256
+	Issuer         string        // required iss, when set
+	Audience       string        // required aud, when set
+	RequiredClaims []string      // claims which must be present
+	Leeway         time.Duration // allowed clock skew when checking exp, nbf and iat
+	CacheSize      int           // verified tokens cached until their exp, 0 disables the cache
+}
+
 type JWTAuthenticator struct {
-	key interface{}
+	keys       KeyProvider
+	validation JWTValidation
+	algorithms map[string]bool
+	cache      *tokenCache
 }
 
-func NewJWTAuthenticator(key interface{}) (*JWTAuthenticator, error) {
-	return &JWTAuthenticator{key}, nil
+// a verified token, with the key it was verified with so that it isn't trusted once the key is rotated out
+type verifiedToken struct {
+	kid    string
+	key    interface{}
+	token  *jwt.Token
+	claims Claims
 }
 
-func (authenticator *JWTAuthenticator) Authenticate(creds interface{}) (*AuthResult, error) {
+func NewJWTAuthenticator(keys KeyProvider, validation JWTValidation) (*JWTAuthenticator, error) {
+	if len(validation.Algorithms) == 0 {
+		return nil, errors.New("no signing algorithms allowed for jwt authentication")
+	}
+
+	algorithms := make(map[string]bool)
+	for _, alg := range validation.Algorithms {
+		if nil == jwt.GetSigningMethod(alg) {
+			return nil, errors.New(fmt.Sprintf("unknown jwt signing algorithm: %v", alg))
+		}
+		if alg == "none" {
+			return nil, errors.New("jwt signing algorithm 'none' cannot be allowed")
+		}
+		algorithms[alg] = true
+	}
+
+	return &JWTAuthenticator{keys, validation, algorithms, newTokenCache(validation.CacheSize)}, nil
+}
+
+// Claims which are not validated by the parser, they are validated with leeway afterwards
+type unvalidatedClaims map[string]interface{}
+
+func (c *unvalidatedClaims) Valid() error {
+	return nil
+}
+
+// checks the time based and required claims of a token
+func (authenticator *JWTAuthenticator) validateClaims(claims jwt.MapClaims) error {
+	now := time.Now().Unix()
+	leeway := int64(authenticator.validation.Leeway / time.Second)
+
+	if !claims.VerifyExpiresAt(now-leeway, false) {
+		return errors.New("token is expired")
+	}
+	if !claims.VerifyNotBefore(now+leeway, false) {
+		return errors.New("token is not valid yet")
+	}
+	if !claims.VerifyIssuedAt(now+leeway, false) {
+		return errors.New("token used before issued")
+	}
+
+	if iss := authenticator.validation.Issuer; iss != "" && !claims.VerifyIssuer(iss, true) {
+		return errors.New(fmt.Sprintf("token issuer is not: %v", iss))
+	}
+	if aud := authenticator.validation.Audience; aud != "" && !hasAudience(claims["aud"], aud) {
+		return errors.New(fmt.Sprintf("token audience does not include: %v", aud))
+	}
+
+	for _, claim := range authenticator.validation.RequiredClaims {
+		if _, ok := claims[claim]; !ok {
+			return errors.New(fmt.Sprintf("token is missing required claim: %v", claim))
+		}
+	}
+
+	return nil
+}
+
+// the aud claim may be a single string or a list
+func hasAudience(aud interface{}, audience string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == audience
+	case []interface{}:
+		for _, v := range a {
+			if s, ok := v.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the result for a token which was verified before, when it is cached and its key is unchanged
+func (authenticator *JWTAuthenticator) FromCache(creds interface{}) (AuthReturn, bool) {
 	token, err := splitToken(creds.(string))
 	if nil != err {
-		return &AuthResult{false, nil}, AuthError{err.Error()}
+		return AuthReturn{}, false
 	}
 
-	parsedToken, err := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
-		return authenticator.key, nil
-	})
+	hash := hashToken(token)
+	cached, ok := authenticator.cache.Get(hash)
+	if !ok {
+		return AuthReturn{}, false
+	}
 
-	if nil != err {
-		return &AuthResult{false, nil}, AuthError{err.Error()}
+	verified := cached.(*verifiedToken)
+	if key, err := authenticator.keys.Key(verified.kid); nil != err || !sameKey(verified.key, key) {
+		authenticator.cache.Invalidate(hash)
+		return AuthReturn{}, false
 	}
-	if nil == parsedToken {
-		return &AuthResult{false, nil}, AuthError{"authentication failed with a nil parsed token"}
+
+	// the time based claims are checked again, the token may be cached until just beyond its exp
+	if err := authenticator.validateClaims(jwt.MapClaims(verified.claims)); nil != err {
+		return AuthReturn{&AuthResult{false, nil, nil}, AuthError{err.Error()}}, true
 	}
 
-	return &AuthResult{true, parsedToken}, nil
+	return AuthReturn{&AuthResult{true, verified.token, verified.claims}, nil}, true
 }
 
-type PooledJWTAuthenticator struct {
-	workerPool    chan chan Job
-	authenticator *JWTAuthenticator
+func (authenticator *JWTAuthenticator) CacheStats() CacheStats {
+	return authenticator.cache.Stats()
 }
 
-// This struct is the return value from a authenticate call
-type AuthReturn struct {
-	AuthResult *AuthResult // true/false + optional artifact (ie decoded jwt token)
-	AuthError  error
+func (authenticator *JWTAuthenticator) Authenticate(creds interface{}) (*AuthResult, error) {
+	if ret, ok := authenticator.FromCache(creds); ok {
+		return ret.AuthResult, ret.AuthError
+	}
+	return authenticator.verify(creds)
 }
 
-// Job represents the job to be run
-type Job struct {
-	Payload  interface{} // credentials
-	RespChan chan AuthReturn
+func (authenticator *JWTAuthenticator) Uncached() Authenticator {
+	return AuthenticatorFunc(authenticator.verify)
 }
 
-// Worker represents the worker that executes the job
-type Worker struct {
-	authenticator Authenticator
-	workerRegPool chan chan Job
-	inJobChannel  chan Job // the worker's own channel which is posted to workerRegPool when the worker is available
-	quitChan      chan bool
-}
+// verifies the token and caches the result
+func (authenticator *JWTAuthenticator) verify(creds interface{}) (*AuthResult, error) {
+	token, err := splitToken(creds.(string))
+	if nil != err {
+		return &AuthResult{false, nil, nil}, AuthError{err.Error()}
+	}
+
+	var verified verifiedToken
+	parsedToken, err := jwt.ParseWithClaims(token, &unvalidatedClaims{}, func(t *jwt.Token) (interface{}, error) {
+		// reject tokens signed with an unexpected algorithm, before their signature is checked
+		if !authenticator.algorithms[t.Method.Alg()] {
+			return nil, errors.New(fmt.Sprintf("unexpected signing algorithm: %v", t.Method.Alg()))
+		}
+
+		// the key is selected by the token's kid, when it has one
+		kid, _ := t.Header["kid"].(string)
+		key, err := authenticator.keys.Key(kid)
+		if nil != err {
+			return nil, err
+		}
+		verified.kid, verified.key = kid, key
+		return key, checkKeyForMethod(key, t.Method)
+	})
 
-func NewPooledJWTAuthenticator(numWorkers int, key interface{}) (*PooledJWTAuthenticator, error) {
-	pool := make(chan chan Job, numWorkers)
-	authenticator, err := NewJWTAuthenticator(key)
 	if nil != err {
-		return nil, err
+		return &AuthResult{false, nil, nil}, AuthError{err.Error()}
+	}
+	if nil == parsedToken {
+		return &AuthResult{false, nil, nil}, AuthError{"authentication failed with a nil parsed token"}
 	}
 
-	// starting n number of workers
-	for i := 0; i < numWorkers; i++ {
-		worker := NewWorker(authenticator, pool)
-		worker.Start()
+	var claims Claims
+	if parsedClaims, ok := parsedToken.Claims.(*unvalidatedClaims); ok {
+		claims = Claims(*parsedClaims)
 	}
 
-	return &PooledJWTAuthenticator{authenticator: authenticator, workerPool: pool}, nil
-}
+	if err := authenticator.validateClaims(jwt.MapClaims(claims)); nil != err {
+		return &AuthResult{false, nil, nil}, AuthError{err.Error()}
+	}
+
+	// only tokens which expire are cached, until their exp plus the leeway
+	if exp, ok := claims["exp"].(float64); ok {
+		verified.token, verified.claims = parsedToken, claims
+		expires := time.Unix(int64(exp), 0).Add(authenticator.validation.Leeway)
+		authenticator.cache.Put(hashToken(token), &verified, expires)
+	}
 
-func NewWorker(authenticator Authenticator, workerRegPool chan chan Job) Worker {
-	return Worker{
-		authenticator: authenticator,
-		workerRegPool: workerRegPool,   // the pool this worker will register on when its available
-		inJobChannel:  make(chan Job),  // the worker's own channel where jobs are sent
-		quitChan:      make(chan bool)} // channel where quit messages are senbt
+	return &AuthResult{true, parsedToken, claims}, nil
 }
 
-// Start method starts the run loop for the worker, listening for a quit channel in
-// case we need to stop it
-func (w *Worker) Start() {
-	go func() {
-		for {
-			// register the current worker into the worker queue.
-			w.workerRegPool <- w.inJobChannel
+// Instantiates a JWTAuthenticator whose authentications run on the worker pool
+func NewPooledJWTAuthenticator(pool *WorkerPool, keys KeyProvider, validation JWTValidation) (*PooledAuthenticator, error) {
+	authenticator, err := NewJWTAuthenticator(keys, validation)
+	if nil != err {
+		return nil, err
+	}
 
-			select {
-			case job := <-w.inJobChannel:
-				res, err := w.authenticator.Authenticate(job.Payload)
-				job.RespChan <- AuthReturn{res, err}
+	return NewPooledAuthenticator(pool, authenticator), nil
+}
 
-			case <-w.quitChan:
-				// we have received a signal to stop
-				return
-			}
-		}
-	}()
+// whether a token is shaped like a jwt, so that opaque tokens can be left to other schemes (ie introspection)
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
 }
 
-func (authenticator *PooledJWTAuthenticator) Authenticate(token interface{}) (*AuthResult, error) {
-	inJobChan := <-authenticator.workerPool // get access to a works job channel
-	authRetChan := make(chan AuthReturn)
-	inJobChan <- Job{token.(string), authRetChan}
-	authRet := <-authRetChan
-	close(authRetChan)
-	return authRet.AuthResult, authRet.AuthError
+// finds the bearer token among the authorization headers, a header without a scheme is taken as a bearer token
+func findBearerToken(authHeader []string) string {
+	for _, h := range authHeader {
+		parts := strings.SplitN(h, " ", 2)
+		if len(parts) == 1 || strings.ToLower(parts[0]) == "bearer" {
+			return h
+		}
+	}
+	return ""
 }
 
 func splitToken(token string) (string, error) {
@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/dgrijalva/jwt-go"
+	"testing"
+	"time"
+)
+
+// the keys tokens are signed with in the tests, the authenticator verifies with the rsa public key
+type testKeys struct {
+	rsa      *rsa.PrivateKey
+	otherRSA *rsa.PrivateKey // a key the authenticator doesn't know
+	ec       *ecdsa.PrivateKey
+	rsaPEM   []byte // the rsa public key, as used by an HS256 key confusion attack
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if nil != err {
+		t.Fatal(err)
+	}
+	otherRSA, err := rsa.GenerateKey(rand.Reader, 2048)
+	if nil != err {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	return testKeys{
+		rsa:      rsaKey,
+		otherRSA: otherRSA,
+		ec:       ecKey,
+		rsaPEM:   pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}),
+	}
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, claims jwt.MapClaims) string {
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestJWTVerification(t *testing.T) {
+	keys := newTestKeys(t)
+	now := time.Now()
+	at := func(d time.Duration) int64 { return now.Add(d).Unix() }
+
+	tests := []struct {
+		name       string
+		method     jwt.SigningMethod
+		signKey    interface{}
+		claims     jwt.MapClaims
+		validation JWTValidation // the algorithms are RS256 when not set
+		valid      bool
+	}{
+		{"rs256", jwt.SigningMethodRS256, keys.rsa, jwt.MapClaims{"sub": "user-1"}, JWTValidation{}, true},
+		{"signed with another key", jwt.SigningMethodRS256, keys.otherRSA, jwt.MapClaims{}, JWTValidation{}, false},
+
+		// algorithms
+		{"none", jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, jwt.MapClaims{}, JWTValidation{}, false},
+		{"hs256 with the rsa public key", jwt.SigningMethodHS256, keys.rsaPEM, jwt.MapClaims{}, JWTValidation{}, false},
+		{"hs256 with the rsa public key, hs256 allowed", jwt.SigningMethodHS256, keys.rsaPEM, jwt.MapClaims{},
+			JWTValidation{Algorithms: []string{"RS256", "HS256"}}, false},
+		{"ps256 not allowed", jwt.SigningMethodPS256, keys.rsa, jwt.MapClaims{}, JWTValidation{}, false},
+		{"ps256 allowed", jwt.SigningMethodPS256, keys.rsa, jwt.MapClaims{},
+			JWTValidation{Algorithms: []string{"RS256", "PS256"}}, true},
+		{"es256 for an rsa key", jwt.SigningMethodES256, keys.ec, jwt.MapClaims{},
+			JWTValidation{Algorithms: []string{"RS256", "ES256"}}, false},
+
+		// issuer and audience
+		{"issuer", jwt.SigningMethodRS256, keys.rsa, jwt.MapClaims{"iss": "https://idp"},
+			JWTValidation{Issuer: "https://idp"}, true},
+		{"wrong issuer", jwt.SigningMethodRS256, keys.rsa, jwt.MapClaims{"iss": "https://evil"},
+			JWTValidation{Issuer: "https://idp"}, false},
+		{"missing issuer", jwt.SigningMethodRS256, keys.rsa, jwt.MapClaims{},
+			JWTValidation{Issuer: "https://idp"}, false},
+		{"audience", jwt.SigningMethodRS256, keys.rsa, jwt.MapClaims{"aud": "api"},
+			JWTValidation{Audience: "api"}, true},
+		{"audience in a list", jwt.SigningMethodRS256, keys.rsa, jwt.MapClaims{"aud": []string{"other", "api"}},
+			JWTValidation{Audience: "api"}, true},
+		{"wrong audience", jwt.SigningMethodRS256, keys.rsa, jwt.MapClaims{"aud": "other"},
+			JWTValidation{Audience: "api"}, false},
+		{"space delimited audience", jwt.SigningMethodRS256, keys.rsa, jwt.MapClaims{"aud": "other api"},
+			JWTValidation{Audience: "api"}, false},
+
+		// required claims
+		{"required claims", jwt.SigningMethodRS256, keys.rsa, jwt.MapClaims{"sub": "user-1", "email": "a@b"},
+			JWTValidation{RequiredClaims: []string{"sub", "email"}}, true},
+		{"missing required claim", jwt.SigningMethodRS256, keys.rsa, jwt.MapClaims{"sub": "user-1"},
+			JWTValidation{RequiredClaims: []string{"sub", "email"}}, false},
+
+		// time based claims, with leeway for clock skew
+		{"not expired", jwt.SigningMethodRS256, keys.rsa, jwt.MapClaims{"exp": at(time.Minute)}, JWTValidation{}, true},
+		{"expired", jwt.SigningMethodRS256, keys.rsa, jwt.MapClaims{"exp": at(-time.Minute)}, JWTValidation{}, false},
+		{"expired within the leeway", jwt.SigningMethodRS256, keys.rsa, jwt.MapClaims{"exp": at(-10 * time.Second)},
+			JWTValidation{Leeway: 30 * time.Second}, true},
+		{"expired beyond the leeway", jwt.SigningMethodRS256, keys.rsa, jwt.MapClaims{"exp": at(-time.Minute)},
+			JWTValidation{Leeway: 30 * time.Second}, false},
+		{"not yet valid", jwt.SigningMethodRS256, keys.rsa, jwt.MapClaims{"nbf": at(time.Minute)}, JWTValidation{}, false},
+		{"not yet valid within the leeway", jwt.SigningMethodRS256, keys.rsa, jwt.MapClaims{"nbf": at(10 * time.Second)},
+			JWTValidation{Leeway: 30 * time.Second}, true},
+		{"not yet valid beyond the leeway", jwt.SigningMethodRS256, keys.rsa, jwt.MapClaims{"nbf": at(time.Minute)},
+			JWTValidation{Leeway: 30 * time.Second}, false},
+		{"issued in the future", jwt.SigningMethodRS256, keys.rsa, jwt.MapClaims{"iat": at(time.Minute)},
+			JWTValidation{Leeway: 30 * time.Second}, false},
+		{"issued within the leeway", jwt.SigningMethodRS256, keys.rsa, jwt.MapClaims{"iat": at(10 * time.Second)},
+			JWTValidation{Leeway: 30 * time.Second}, true},
+	}
+
+	for _, test := range tests {
+		validation := test.validation
+		if len(validation.Algorithms) == 0 {
+			validation.Algorithms = []string{"RS256"}
+		}
+		authenticator, err := NewJWTAuthenticator(NewStaticKey(&keys.rsa.PublicKey), validation)
+		if nil != err {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+
+		token := signToken(t, test.method, test.signKey, test.claims)
+		result, err := authenticator.Authenticate("Bearer " + token)
+		valid := nil == err && nil != result && result.Success
+		if valid != test.valid {
+			t.Errorf("%v: expected valid: %v, got: %v, %v", test.name, test.valid, valid, err)
+		}
+	}
+}
+
+func TestJWTAlgorithmsCannotAllowNone(t *testing.T) {
+	validation := JWTValidation{Algorithms: []string{"RS256", "none"}}
+	if _, err := NewJWTAuthenticator(NewStaticKey(nil), validation); nil == err {
+		t.Error("expected the none algorithm to be refused")
+	}
+
+	if _, err := NewJWTAuthenticator(NewStaticKey(nil), JWTValidation{}); nil == err {
+		t.Error("expected an error with no algorithms allowed")
+	}
+}
+
+// a cached token is still checked against its exp
+func TestJWTCachedTokenExpires(t *testing.T) {
+	keys := newTestKeys(t)
+	authenticator, err := NewJWTAuthenticator(NewStaticKey(&keys.rsa.PublicKey),
+		JWTValidation{Algorithms: []string{"RS256"}, CacheSize: 10})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	token := signToken(t, jwt.SigningMethodRS256, keys.rsa, jwt.MapClaims{"exp": time.Now().Add(time.Second).Unix()})
+	if result, err := authenticator.Authenticate("Bearer " + token); nil != err || !result.Success {
+		t.Fatalf("expected the token to be valid, got: %v", err)
+	}
+	if stats := authenticator.CacheStats(); stats.Size != 1 {
+		t.Fatalf("expected the token to be cached, got: %v entries", stats.Size)
+	}
+
+	time.Sleep(2 * time.Second)
+	if result, err := authenticator.Authenticate("Bearer " + token); nil == err || result.Success {
+		t.Error("expected the cached token to have expired")
+	}
+}
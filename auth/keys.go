@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// key types, when not set the type is detected from the pem
+const (
+	KeyTypeRSA  = "rsa" // RS256/384/512 and PS256/384/512
+	KeyTypeEC   = "ec"  // ES256/384/512
+	KeyTypeHMAC = "hmac"
+)
+
+// Parses a public key from a pem, either a public key or a certificate. When keyType is
+// empty, the type is detected from the pem
+func ParsePublicKeyPEM(pemCtnt []byte, keyType string) (interface{}, error) {
+	if block, _ := pem.Decode(pemCtnt); nil == block {
+		return nil, errors.New("key is not pem encoded")
+	}
+
+	switch keyType {
+	case KeyTypeRSA:
+		return jwt.ParseRSAPublicKeyFromPEM(pemCtnt)
+	case KeyTypeEC:
+		return jwt.ParseECPublicKeyFromPEM(pemCtnt)
+	case "":
+		if key, err := jwt.ParseRSAPublicKeyFromPEM(pemCtnt); nil == err {
+			return key, nil
+		}
+		if key, err := jwt.ParseECPublicKeyFromPEM(pemCtnt); nil == err {
+			return key, nil
+		}
+		return nil, errors.New("pem is not an rsa or ec public key")
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported key type for a pem: %v", keyType))
+	}
+}
+
+// The algorithms allowed by default for the keys, the most common one of the key's own type
+func DefaultAlgorithms(keys KeyProvider) []string {
+	var key interface{} = keys
+	if staticKey, ok := keys.(*StaticKey); ok {
+		key = staticKey.key
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return []string{"RS256"} // PS256 is opt in, through the configured algorithms
+	case *ecdsa.PublicKey:
+		switch k.Curve.Params().BitSize {
+		case 384:
+			return []string{"ES384"}
+		case 521:
+			return []string{"ES512"}
+		default:
+			return []string{"ES256"}
+		}
+	case []byte:
+		return []string{"HS256"}
+	default:
+		return []string{"RS256", "ES256"} // ie a jwks, which may have keys of either type
+	}
+}
+
+// Checks that a key can verify tokens signed with the method, so that a token can't choose how its
+// own signature is checked (ie an HMAC token checked with an RSA public key as the secret)
+func checkKeyForMethod(key interface{}, method jwt.SigningMethod) error {
+	ok := false
+	switch m := method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		_, ok = key.(*rsa.PublicKey)
+	case *jwt.SigningMethodECDSA:
+		var ecKey *ecdsa.PublicKey
+		if ecKey, ok = key.(*ecdsa.PublicKey); ok {
+			ok = ecKey.Curve.Params().BitSize == m.CurveBits
+		}
+	case *jwt.SigningMethodHMAC:
+		_, ok = key.([]byte)
+	}
+
+	if !ok {
+		return errors.New(fmt.Sprintf("key of type %T can't verify signing algorithm: %v", key, method.Alg()))
+	}
+	return nil
+}
+
+// Whether two keys are the same, ie whether a key is still the one a token was verified with
+func sameKey(a interface{}, b interface{}) bool {
+	if secret, ok := a.([]byte); ok {
+		other, ok := b.([]byte)
+		return ok && bytes.Equal(secret, other)
+	}
+	if pk, ok := a.(interface{ Equal(crypto.PublicKey) bool }); ok {
+		return pk.Equal(b)
+	}
+	return false
+}
@@ -0,0 +1,280 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// the least time between refreshes triggered by tokens with an unknown kid, so that tokens
+// with made up kids can't hammer the jwks source
+const minKeyRefreshInterval = 10 * time.Second
+
+// A KeyProvider returns the key to verify a token with, selected by the token's kid header
+type KeyProvider interface {
+	Key(kid string) (interface{}, error)
+}
+
+// A single key, used whatever the token's kid
+type StaticKey struct {
+	key interface{}
+}
+
+func NewStaticKey(key interface{}) *StaticKey {
+	return &StaticKey{key}
+}
+
+func (k *StaticKey) Key(kid string) (interface{}, error) {
+	return k.key, nil
+}
+
+// Fetches the raw json of a jwks
+type JWKSFetcher func() ([]byte, error)
+
+// Returns a fetcher which gets a jwks from a url
+func JWKSURLFetcher(url string, timeout time.Duration) JWKSFetcher {
+	client := &http.Client{Timeout: timeout}
+	return func() ([]byte, error) {
+		resp, err := client.Get(url)
+		if nil != err {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New(fmt.Sprintf("unexpected status: %v fetching jwks from: %v", resp.StatusCode, url))
+		}
+		return ioutil.ReadAll(resp.Body)
+	}
+}
+
+// A set of keys from a jwks, selected by kid. The set is cached and refreshed periodically, and when
+// a token arrives with a kid the set doesn't have, so that signing keys can be rotated without a restart.
+type JWKSKeySet struct {
+	name          string
+	fetch         JWKSFetcher
+	keys          map[string]interface{}
+	lastAttempt   time.Time     // of the last fetch, successful or not. guarded by refreshLock
+	minKidRefresh time.Duration // the least time between refreshes for unknown kids
+	lock          sync.RWMutex
+	refreshLock   sync.Mutex
+	quitChan      chan bool
+}
+
+// Instantiates a JWKSKeySet, fetching the keys immediately. A refresh interval of 0 disables periodic refresh
+func NewJWKSKeySet(name string, fetch JWKSFetcher, refresh time.Duration) (*JWKSKeySet, error) {
+	ks := &JWKSKeySet{name: name, fetch: fetch, minKidRefresh: minKeyRefreshInterval, quitChan: make(chan bool)}
+	if err := ks.Refresh(); nil != err {
+		return nil, err
+	}
+
+	if refresh > 0 {
+		go ks.refreshLoop(refresh)
+	}
+
+	return ks, nil
+}
+
+func (ks *JWKSKeySet) refreshLoop(refresh time.Duration) {
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := ks.Refresh(); nil != err {
+				log.Errorf("failed to refresh jwks: %v, keeping the current keys, %v", ks.name, err)
+			}
+		case <-ks.quitChan:
+			return
+		}
+	}
+}
+
+// Stops the periodic refresh
+func (ks *JWKSKeySet) Stop() {
+	close(ks.quitChan)
+}
+
+// Fetches and parses the jwks, replacing the current keys. The current keys are kept on failure
+func (ks *JWKSKeySet) Refresh() error {
+	ks.refreshLock.Lock()
+	defer ks.refreshLock.Unlock()
+
+	return ks.refresh()
+}
+
+// Refreshes the keys for a token with an unknown kid, unless they were fetched within the last minKidRefresh.
+// The interval is checked under the refresh lock, so that a burst of such tokens fetches the jwks once
+func (ks *JWKSKeySet) refreshForKid() error {
+	ks.refreshLock.Lock()
+	defer ks.refreshLock.Unlock()
+
+	if time.Since(ks.lastAttempt) < ks.minKidRefresh {
+		return nil
+	}
+	return ks.refresh()
+}
+
+// fetches the keys with the refresh lock held. The attempt is recorded even when it fails, so that a failing
+// jwks source isn't fetched again for every token with an unknown kid
+func (ks *JWKSKeySet) refresh() error {
+	ks.lastAttempt = time.Now()
+
+	ctnt, err := ks.fetch()
+	if nil != err {
+		return err
+	}
+
+	keys, err := ParseJWKS(ctnt)
+	if nil != err {
+		return err
+	}
+
+	ks.lock.Lock()
+	ks.keys = keys
+	ks.lock.Unlock()
+
+	log.Infof("loaded %v keys from jwks: %v", len(keys), ks.name)
+	return nil
+}
+
+// Returns the key for the kid. A token without a kid can only be verified when the set has a single key
+func (ks *JWKSKeySet) Key(kid string) (interface{}, error) {
+	if key, ok := ks.lookup(kid); ok {
+		return key, nil
+	}
+
+	// the key may have been rotated in since the last refresh
+	if kid != "" {
+		if err := ks.refreshForKid(); nil != err {
+			log.Errorf("failed to refresh jwks: %v for kid: %v, %v", ks.name, kid, err)
+		} else if key, ok := ks.lookup(kid); ok {
+			return key, nil
+		}
+	}
+
+	return nil, errors.New(fmt.Sprintf("no key found for kid: '%v'", kid))
+}
+
+func (ks *JWKSKeySet) lookup(kid string) (interface{}, bool) {
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+
+	if kid == "" {
+		if len(ks.keys) == 1 {
+			for _, key := range ks.keys {
+				return key, true
+			}
+		}
+		return nil, false
+	}
+
+	key, ok := ks.keys[kid]
+	return key, ok
+}
+
+// a single json web key, only the members needed for rsa and ec public keys
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Parses a jwks into its public keys by kid. Keys which are not for signatures, or of an unsupported
+// type, are skipped
+func ParseJWKS(ctnt []byte) (map[string]interface{}, error) {
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(ctnt, &jwks); nil != err {
+		return nil, errors.New(fmt.Sprintf("failed to parse jwks: %v", err))
+	}
+
+	keys := make(map[string]interface{})
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if nil != err {
+			log.Warnf("skipping jwk: '%v', %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("jwks has no usable keys")
+	}
+
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if nil != err {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if nil != err {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New(fmt.Sprintf("unsupported curve: %v", k.Crv))
+		}
+		x, err := decodeBigInt(k.X)
+		if nil != err {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if nil != err {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported key type: %v", k.Kty))
+	}
+}
+
+// decodes a base64url encoded big endian integer
+func decodeBigInt(s string) (*big.Int, error) {
+	if s == "" {
+		return nil, errors.New("missing key parameter")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if nil != err {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Serves a jwks which can be rotated, counting the fetches
+type jwksServer struct {
+	*httptest.Server
+	keys    map[string]*rsa.PrivateKey
+	failing bool
+	fetches int32
+	lock    sync.Mutex
+}
+
+func newJWKSServer() *jwksServer {
+	s := &jwksServer{keys: make(map[string]*rsa.PrivateKey)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.fetches, 1)
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		var jwks struct {
+			Keys []jwk `json:"keys"`
+		}
+		for kid, key := range s.keys {
+			jwks.Keys = append(jwks.Keys, jwk{
+				Kty: "RSA",
+				Kid: kid,
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	return s
+}
+
+// replaces the served keys with a new key for each kid
+func (s *jwksServer) rotate(t *testing.T, kids ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.keys = make(map[string]*rsa.PrivateKey)
+	for _, kid := range kids {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		if nil != err {
+			t.Fatal(err)
+		}
+		s.keys[kid] = key
+	}
+}
+
+func (s *jwksServer) setFailing(failing bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failing = failing
+}
+
+func (s *jwksServer) fetchCount() int32 {
+	return atomic.LoadInt32(&s.fetches)
+}
+
+func (s *jwksServer) publicKey(kid string) *rsa.PublicKey {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return &s.keys[kid].PublicKey
+}
+
+func newTestKeySet(t *testing.T, s *jwksServer) *JWKSKeySet {
+	ks, err := NewJWKSKeySet(s.URL, JWKSURLFetcher(s.URL, time.Second), 0)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+func assertKey(t *testing.T, ks *JWKSKeySet, kid string, expected *rsa.PublicKey) {
+	key, err := ks.Key(kid)
+	if nil != err {
+		t.Fatalf("no key for kid: %v, %v", kid, err)
+	}
+	if rsaKey, ok := key.(*rsa.PublicKey); !ok || rsaKey.N.Cmp(expected.N) != 0 {
+		t.Fatalf("wrong key for kid: %v", kid)
+	}
+}
+
+func TestJWKSRotation(t *testing.T) {
+	s := newJWKSServer()
+	defer s.Close()
+	s.rotate(t, "key-1")
+
+	ks := newTestKeySet(t, s)
+	assertKey(t, ks, "key-1", s.publicKey("key-1"))
+
+	// a token signed with the rotated in key triggers a refresh
+	ks.minKidRefresh = 0
+	s.rotate(t, "key-2")
+	assertKey(t, ks, "key-2", s.publicKey("key-2"))
+
+	// the rotated out key is gone with the refresh
+	if _, err := ks.Key("key-1"); nil == err {
+		t.Error("expected no key for the rotated out kid")
+	}
+}
+
+func TestJWKSUnknownKidRefreshIsThrottled(t *testing.T) {
+	s := newJWKSServer()
+	defer s.Close()
+	s.rotate(t, "key-1")
+
+	ks := newTestKeySet(t, s)
+	fetches := s.fetchCount()
+
+	// the set was just fetched, so made up kids don't fetch it again
+	for i := 0; i < 5; i++ {
+		if _, err := ks.Key("made-up"); nil == err {
+			t.Fatal("expected no key for a made up kid")
+		}
+	}
+	if s.fetchCount() != fetches {
+		t.Errorf("expected no fetches within the refresh interval, got: %v", s.fetchCount()-fetches)
+	}
+}
+
+func TestJWKSConcurrentUnknownKidsFetchOnce(t *testing.T) {
+	s := newJWKSServer()
+	defer s.Close()
+	s.rotate(t, "key-1")
+
+	ks := newTestKeySet(t, s)
+	ks.lastAttempt = time.Time{} // as if the interval has passed
+	s.rotate(t, "key-2")
+	fetches := s.fetchCount()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ks.Key("key-2")
+		}()
+	}
+	wg.Wait()
+
+	if n := s.fetchCount() - fetches; n != 1 {
+		t.Errorf("expected a single fetch for concurrent unknown kids, got: %v", n)
+	}
+	assertKey(t, ks, "key-2", s.publicKey("key-2"))
+}
+
+func TestJWKSFailedRefreshIsThrottled(t *testing.T) {
+	s := newJWKSServer()
+	defer s.Close()
+	s.rotate(t, "key-1")
+
+	ks := newTestKeySet(t, s)
+	ks.lastAttempt = time.Time{}
+	s.setFailing(true)
+	fetches := s.fetchCount()
+
+	// the failed attempt counts against the interval, so the source isn't fetched for every token
+	ks.Key("key-2")
+	ks.Key("key-2")
+	if n := s.fetchCount() - fetches; n != 1 {
+		t.Errorf("expected a single fetch while the source is failing, got: %v", n)
+	}
+
+	// the current keys are kept
+	assertKey(t, ks, "key-1", s.publicKey("key-1"))
+}
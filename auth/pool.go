@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	gwlog "github.com/seansitter/gogw/log"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// errors of a pooled authentication, which never reached a worker
+var (
+	ErrPoolBusy    = errors.New("auth worker pool is busy")
+	ErrPoolStopped = errors.New("auth worker pool is stopped")
+)
+
+// A pool of workers for computationally expensive, or slow, authentication (ie jwt signatures, token
+// introspection). The pool is shared by the gateway's authenticators. Callers wait for a free worker in
+// a bounded queue, for no longer than the queue timeout
+type WorkerPool struct {
+	workerPool   chan chan Job
+	queue        chan bool // a slot is held by each caller waiting for a worker
+	queueTimeout time.Duration
+	quitChan     chan bool
+	stopOnce     sync.Once
+	workers      sync.WaitGroup
+}
+
+// An Authenticator with a cache of results, which can be answered without waiting on a worker
+type CachingAuthenticator interface {
+	Authenticator
+	FromCache(creds interface{}) (AuthReturn, bool)
+	Uncached() Authenticator // authenticates without checking the cache, the result is still cached
+	CacheStats() CacheStats
+}
+
+// An Authenticator which gives up when the context is done, ie the client disconnected
+type ContextAuthenticator interface {
+	Authenticator
+	AuthenticateContext(ctx context.Context, creds interface{}) (*AuthResult, error)
+}
+
+// Adapts a function to an Authenticator
+type AuthenticatorFunc func(creds interface{}) (*AuthResult, error)
+
+func (f AuthenticatorFunc) Authenticate(creds interface{}) (*AuthResult, error) {
+	return f(creds)
+}
+
+// An authenticator whose authentications run on a worker pool
+type PooledAuthenticator struct {
+	pool          *WorkerPool
+	authenticator Authenticator
+}
+
+// This struct is the return value from a authenticate call
+type AuthReturn struct {
+	AuthResult *AuthResult // true/false + optional artifact (ie decoded jwt token)
+	AuthError  error
+}
+
+// Job represents the job to be run
+type Job struct {
+	Authenticator Authenticator
+	Payload       interface{}     // credentials
+	RespChan      chan AuthReturn // buffered, so a worker never blocks on a caller which gave up
+	Log           *log.Entry      // the logger of the request being authenticated, ie with its request id
+}
+
+// Worker represents the worker that executes the job
+type Worker struct {
+	workerRegPool chan chan Job
+	inJobChannel  chan Job // the worker's own channel which is posted to workerRegPool when the worker is available
+	quitChan      chan bool
+}
+
+// Instantiates a pool of workers. When every worker is busy, at most queueDepth callers wait for one, each for
+// no longer than the queue timeout. A timeout of 0 waits until the caller's context is done
+func NewWorkerPool(numWorkers int, queueDepth int, queueTimeout time.Duration) *WorkerPool {
+	pool := &WorkerPool{
+		workerPool:   make(chan chan Job, numWorkers),
+		queue:        make(chan bool, queueDepth),
+		queueTimeout: queueTimeout,
+		quitChan:     make(chan bool),
+	}
+
+	// starting n number of workers
+	for i := 0; i < numWorkers; i++ {
+		worker := NewWorker(pool.workerPool, pool.quitChan)
+		pool.workers.Add(1)
+		go func() {
+			defer pool.workers.Done()
+			worker.Run()
+		}()
+	}
+
+	return pool
+}
+
+func NewWorker(workerRegPool chan chan Job, quitChan chan bool) Worker {
+	return Worker{
+		workerRegPool: workerRegPool,  // the pool this worker will register on when its available
+		inJobChannel:  make(chan Job), // the worker's own channel where jobs are sent
+		quitChan:      quitChan}       // closed when the worker should stop
+}
+
+// Start method starts the run loop for the worker, listening for a quit channel in
+// case we need to stop it
+func (w *Worker) Start() {
+	go w.Run()
+}
+
+// Runs jobs until the quit channel is closed
+func (w *Worker) Run() {
+	for {
+		// register the current worker into the worker queue.
+		select {
+		case w.workerRegPool <- w.inJobChannel:
+		case <-w.quitChan:
+			return
+		}
+
+		select {
+		case job := <-w.inJobChannel:
+			job.RespChan <- w.runJob(job)
+
+		case <-w.quitChan:
+			// we have received a signal to stop
+			return
+		}
+	}
+}
+
+// runs the job, logging how long it took with the request's logger
+func (w *Worker) runJob(job Job) AuthReturn {
+	start := time.Now()
+	res, err := job.Authenticator.Authenticate(job.Payload)
+	if nil != job.Log {
+		job.Log.Debugf("authentication on an auth worker took: %v", time.Since(start))
+	}
+	return AuthReturn{res, err}
+}
+
+// Runs the authentication on one of the pool's workers
+func (pool *WorkerPool) Authenticate(authenticator Authenticator, creds interface{}) (*AuthResult, error) {
+	return pool.AuthenticateContext(context.Background(), authenticator, creds)
+}
+
+// Runs the authentication on one of the pool's workers. ErrPoolBusy is returned when the queue is full or the
+// wait for a worker times out, and the context's error when it is done first
+func (pool *WorkerPool) AuthenticateContext(ctx context.Context, authenticator Authenticator, creds interface{}) (*AuthResult, error) {
+	inJobChan, err := pool.nextWorker(ctx)
+	if nil != err {
+		return nil, err
+	}
+
+	authRetChan := make(chan AuthReturn, 1)
+	select {
+	case inJobChan <- Job{authenticator, creds, authRetChan, gwlog.FromContext(ctx)}:
+	case <-pool.quitChan:
+		return nil, ErrPoolStopped
+	}
+
+	select {
+	case authRet := <-authRetChan:
+		return authRet.AuthResult, authRet.AuthError
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// returns the job channel of a free worker, waiting in the queue when there is none
+func (pool *WorkerPool) nextWorker(ctx context.Context) (chan Job, error) {
+	select {
+	case inJobChan := <-pool.workerPool:
+		return inJobChan, nil
+	default:
+	}
+
+	// take a place in the queue, failing fast when it is full
+	select {
+	case pool.queue <- true:
+		defer func() { <-pool.queue }()
+	default:
+		return nil, ErrPoolBusy
+	}
+
+	var timeout <-chan time.Time
+	if pool.queueTimeout > 0 {
+		timer := time.NewTimer(pool.queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case inJobChan := <-pool.workerPool:
+		return inJobChan, nil
+	case <-timeout:
+		return nil, ErrPoolBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-pool.quitChan:
+		return nil, ErrPoolStopped
+	}
+}
+
+// The number of callers waiting for a worker
+func (pool *WorkerPool) QueueLen() int {
+	return len(pool.queue)
+}
+
+// Stops the workers, after they finish the jobs they are running. Callers still waiting get ErrPoolStopped
+func (pool *WorkerPool) Stop() {
+	pool.stopOnce.Do(func() {
+		close(pool.quitChan)
+	})
+	pool.workers.Wait()
+}
+
+func NewPooledAuthenticator(pool *WorkerPool, authenticator Authenticator) *PooledAuthenticator {
+	return &PooledAuthenticator{pool, authenticator}
+}
+
+func (authenticator *PooledAuthenticator) Authenticate(creds interface{}) (*AuthResult, error) {
+	return authenticator.AuthenticateContext(context.Background(), creds)
+}
+
+func (authenticator *PooledAuthenticator) AuthenticateContext(ctx context.Context, creds interface{}) (*AuthResult, error) {
+	if caching, ok := authenticator.authenticator.(CachingAuthenticator); ok {
+		if ret, ok := caching.FromCache(creds); ok {
+			return ret.AuthResult, ret.AuthError
+		}
+		return authenticator.pool.AuthenticateContext(ctx, caching.Uncached(), creds)
+	}
+	return authenticator.pool.AuthenticateContext(ctx, authenticator.authenticator, creds)
+}
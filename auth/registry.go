@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"github.com/seansitter/gogw/httperr"
+	"net/http"
+	"sync"
+)
+
+// A registry of auth handlers by scheme name, ie jwt, apikey. Endpoints choose the schemes they accept
+// by name, so custom handlers can be registered when gogw is embedded as a library
+type Registry struct {
+	handlers map[string]AuthHandler
+	lock     sync.RWMutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{handlers: make(map[string]AuthHandler)}
+}
+
+// Registers the handler for a scheme, a scheme can only be registered once
+func (reg *Registry) Register(scheme string, h AuthHandler) error {
+	if scheme == "" || scheme == "none" {
+		return errors.New(fmt.Sprintf("invalid auth scheme name: '%v'", scheme))
+	}
+	if nil == h {
+		return errors.New(fmt.Sprintf("nil auth handler for scheme: %v", scheme))
+	}
+
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	if _, ok := reg.handlers[scheme]; ok {
+		return errors.New(fmt.Sprintf("auth scheme: %v is already registered", scheme))
+	}
+	reg.handlers[scheme] = h
+	return nil
+}
+
+// Returns the handler for a scheme
+func (reg *Registry) Handler(scheme string) (AuthHandler, bool) {
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+
+	h, ok := reg.handlers[scheme]
+	return h, ok
+}
+
+// Returns a handler which tries each of the schemes in order. The first scheme which finds its credentials
+// on the request decides the result, the rest are not tried
+func (reg *Registry) Chain(schemes []string) (AuthHandler, error) {
+	handlers := make([]AuthHandler, len(schemes))
+	for i, scheme := range schemes {
+		h, ok := reg.Handler(scheme)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("no auth handler registered for scheme: %v", scheme))
+		}
+		handlers[i] = h
+	}
+
+	if len(handlers) == 1 {
+		return handlers[0], nil
+	}
+
+	return func(r *http.Request) (*AuthResult, *httperr.Error) {
+		for _, h := range handlers {
+			result, httpErr := h(r)
+			if httpErr != NoCredentials {
+				return result, httpErr
+			}
+		}
+		return nil, NoCredentials
+	}, nil
+}
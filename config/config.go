@@ -4,17 +4,154 @@ import (
 	"errors"
 	"fmt"
 	"gopkg.in/yaml.v2"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
 	"time"
 )
 
 const defaultLoglevel = "info"
 
+// load balancing strategies across an endpoint's urls
+const (
+	BalanceRoundRobin     = "roundRobin"
+	BalanceWeighted       = "weighted"
+	BalanceLeastRequests  = "leastRequests"  // least outstanding requests
+	BalanceConsistentHash = "consistentHash" // on a header or cookie
+)
+
+// built in authentication schemes of an endpoint, others may be registered when gogw is embedded
+const (
+	AuthJWT           = "jwt"
+	AuthAPIKey        = "apikey"
+	AuthIntrospection = "introspection" // opaque tokens, checked with the identity provider
+	AuthNone          = "none"
+)
+
+// adaptive concurrency limit algorithms
+const (
+	LimitAIMD     = "aimd"     // additive increase, multiplicative decrease on failures and slow responses
+	LimitGradient = "gradient" // follows the ratio of the long term to the latest latency
+)
+
+// what identifies the client a rate limit applies to
+const (
+	RateLimitIP     = "ip"     // the client's address
+	RateLimitSub    = "sub"    // the sub claim of the authenticated principal
+	RateLimitAPIKey = "apikey" // the id of the api key the request authenticated with
+	RateLimitHeader = "header" // the value of a request header
+)
+
+// circuit breaker trip policies
+const (
+	TripConsecutiveFailures = "consecutiveFailures" // trip after failuresToOpen consecutive failures
+	TripFailureRatio        = "failureRatio"        // trip when the ratio of failures reaches failureRatio
+	TripSlowCallRatio       = "slowCallRatio"       // trip when the ratio of slow or failed calls reaches slowCallRatio
+)
+
 type Endpoint struct {
 	Name            string
 	Key             string
 	URL             string
-	Authenticate    bool
-	SharedTransport string `yaml:"sharedTransport"`
+	Authenticate    bool              // deprecated, in favour of auth. true is the same as auth: jwt
+	Auth            AuthSchemes       `yaml:"auth"` // the schemes accepted, in order, ie jwt, apikey or none
+	SharedTransport string            `yaml:"sharedTransport"`
+	Proxy           *Proxy            `yaml:"proxy"`          // optional, merged over the global proxy config
+	CircuitBreaker  *CircuitBreaker   `yaml:"circuitBreaker"` // optional, merged over the global circuit breaker config
+	StripPrefix     string            `yaml:"stripPrefix"`    // removed from the request path before proxying
+	AddPrefix       string            `yaml:"addPrefix"`      // prepended to the request path, after stripping and rewriting
+	Rewrite         []RewriteRule     `yaml:"rewrite"`        // applied in order, after stripPrefix
+	Match           *RouteMatch       `yaml:"match"`          // optional, defaults to the path prefix /<name>
+	URLs            []Upstream        `yaml:"urls"`           // multiple upstreams, in place of url
+	LoadBalancer    *LoadBalancer     `yaml:"loadBalancer"`
+	HealthCheck     *HealthCheck      `yaml:"healthCheck"`  // optional active health checking of the upstreams
+	Retry           *Retry            `yaml:"retry"`        // optional retries of idempotent requests
+	ClaimHeaders    map[string]string `yaml:"claimHeaders"` // claims of the authenticated principal forwarded as headers, claim -> header
+	Authorize       []AuthzRule       `yaml:"authorize"`    // claims based authorization, after authentication
+	Concurrency     *Concurrency      `yaml:"concurrency"`  // optional limit on the requests in flight to the upstreams
+	RateLimit       *RateLimit        `yaml:"rateLimit"`    // optional limit on the rate of requests from each client
+}
+
+// Limits the rate of requests from each client with a token bucket. Requests over the limit get a 429. Limits
+// keyed on ip or a header apply before authentication, those keyed on sub or apikey after it. A client keyed on
+// sub or apikey whose request has neither is keyed on its ip instead
+type RateLimit struct {
+	RequestsPerSecond float64 `yaml:"requestsPerSecond"` // the rate the bucket refills at
+	Burst             int     // requests which may be made at once, defaults to requestsPerSecond rounded up
+	Key               string  // what identifies a client: ip, sub, apikey or header. defaults to ip
+	Header            string  // the header identifying a client, for key: header
+}
+
+// Limits the requests in flight to an endpoint. Requests beyond the limit wait in the queue, or get a 503
+type Concurrency struct {
+	Max            int            // requests in flight, the initial limit when adaptive
+	QueueDepth     int            `yaml:"queueDepth"`     // requests which may wait for a place, 0 for none
+	QueueTimeoutMs time.Duration  `yaml:"queueTimeoutMs"` // the longest a request waits for a place
+	Adaptive       *AdaptiveLimit `yaml:"adaptive"`       // optional, tunes the limit from upstream latency
+}
+
+// An adaptive concurrency limit, tuned between minLimit and maxLimit
+type AdaptiveLimit struct {
+	Algorithm          string        // aimd or gradient
+	MinLimit           int           `yaml:"minLimit"`
+	MaxLimit           int           `yaml:"maxLimit"`
+	LatencyThresholdMs time.Duration `yaml:"latencyThresholdMs"` // aimd, slower responses back the limit off
+	BackoffRatio       float64       `yaml:"backoffRatio"`       // the limit is multiplied by this on a failure, 0-1
+	Smoothing          float64       // gradient, the weight given to each new limit, 0-1
+}
+
+// An authorization rule. Every rule which applies to a request must pass, a rule applies when the
+// request matches its path prefix and methods, or to all requests when they are not set.
+type AuthzRule struct {
+	Path     string              // optional path prefix the rule applies to
+	Methods  []string            // optional methods the rule applies to
+	Scopes   []string            // required scopes, from the scope or scp claim
+	Audience string              // must be one of the aud claim's values
+	Issuer   string              // must equal the iss claim
+	Claims   map[string][]string // each claim must equal, or contain, one of the values
+}
+
+// Retries of idempotent requests to an endpoint
+type Retry struct {
+	Attempts         int           // retries after the first attempt
+	Statuses         []int         // response statuses to retry, ie 502, 503
+	ConnectErrors    bool          `yaml:"connectErrors"`    // retry when the connection fails or is reset before a response
+	BaseBackoffMs    time.Duration `yaml:"baseBackoffMs"`    // doubled on each retry, with jitter
+	MaxBackoffMs     time.Duration `yaml:"maxBackoffMs"`     // cap on the backoff
+	BudgetPercent    float64       `yaml:"budgetPercent"`    // retries allowed as a percentage of requests
+	MinRetriesPerSec int           `yaml:"minRetriesPerSec"` // retries always allowed, regardless of the budget
+}
+
+// Active health checking of an endpoint's upstreams
+type HealthCheck struct {
+	Path               string
+	IntervalMs         time.Duration `yaml:"intervalMs"`
+	TimeoutMs          time.Duration `yaml:"timeoutMs"`
+	HealthyThreshold   int           `yaml:"healthyThreshold"`   // consecutive passes to become healthy
+	UnhealthyThreshold int           `yaml:"unhealthyThreshold"` // consecutive failures to become unhealthy
+	ExpectedStatus     int           `yaml:"expectedStatus"`
+}
+
+// One of an endpoint's upstream instances
+type Upstream struct {
+	URL    string
+	Weight int // used by the weighted strategy, defaults to 1
+}
+
+// How requests are balanced across an endpoint's urls
+type LoadBalancer struct {
+	Strategy   string
+	HashHeader string `yaml:"hashHeader"` // consistentHash key, checked before the cookie
+	HashCookie string `yaml:"hashCookie"` // consistentHash key
+}
+
+// A regex rewrite of the request path, replace may reference capture groups (ie $1)
+type RewriteRule struct {
+	Match   string
+	Replace string
 }
 
 type Proxy struct {
@@ -26,6 +163,20 @@ type Proxy struct {
 	DialTimeoutMs           time.Duration `yaml:"dialTimeoutMs"`
 	DialKeepAliveMs         time.Duration `yaml:"dialKeepAliveMs"`
 	ResponseHeaderTimeoutMs time.Duration `yaml:"responseHeaderTimeoutMs"` // ie: time to first byte
+	RequestTimeoutMs        time.Duration `yaml:"requestTimeoutMs"`        // total time for a proxied request, 0 for none
+	MaxConnsPerHost         int           `yaml:"maxConnsPerHost"`         // 0 for no limit
+	EnableHTTP2             *bool         `yaml:"enableHttp2"`
+	DisableCompression      *bool         `yaml:"disableCompression"`
+}
+
+// whether the transport should attempt http/2
+func (proxy *Proxy) HTTP2Enabled() bool {
+	return nil != proxy.EnableHTTP2 && *proxy.EnableHTTP2
+}
+
+// whether the transport should not request gzip compression from the endpoint
+func (proxy *Proxy) CompressionDisabled() bool {
+	return nil != proxy.DisableCompression && *proxy.DisableCompression
 }
 
 type CircuitBreaker struct {
@@ -33,6 +184,11 @@ type CircuitBreaker struct {
 	ClearFailureCountIntervalMs time.Duration `yaml:"clearFailureCountIntervalMs"`
 	HalfOpenAfterMs             time.Duration `yaml:"halfOpenAfterMs"`
 	FailuresToOpen              int           `yaml:"failuresToOpen"`
+	TripPolicy                  string        `yaml:"tripPolicy"`
+	MinRequests                 uint32        `yaml:"minRequests"`   // requests needed before a ratio policy can trip
+	FailureRatio                float64       `yaml:"failureRatio"`  // 0-1
+	SlowCallMs                  time.Duration `yaml:"slowCallMs"`    // calls slower than this count as failures for slowCallRatio
+	SlowCallRatio               float64       `yaml:"slowCallRatio"` // 0-1
 }
 
 type Server struct {
@@ -42,8 +198,63 @@ type Server struct {
 }
 
 type Gateway struct {
-	PEMFile     string `yaml:"pemfile"`
-	AuthWorkers int    `yaml:"authWorkers"`
+	PEMFile              string         `yaml:"pemfile"`
+	AuthWorkers          int            `yaml:"authWorkers"`
+	AuthQueueDepth       int            `yaml:"authQueueDepth"`       // requests which may wait for a busy auth worker, -1 for none
+	AuthQueueTimeoutMs   time.Duration  `yaml:"authQueueTimeoutMs"`   // the longest a request waits for an auth worker before a 503
+	ConfigPollIntervalMs time.Duration  `yaml:"configPollIntervalMs"` // how often the config file is checked for changes
+	JWT                  JWT            `yaml:"jwt"`
+	JWKS                 *JWKS          `yaml:"jwks"`           // used in place of the pemfile when set
+	KeyType              string         `yaml:"keyType"`        // rsa, ec or hmac, detected from the pemfile when not set
+	HMACSecretFile       string         `yaml:"hmacSecretFile"` // hmac secret, for keyType hmac
+	HMACSecretEnv        string         `yaml:"hmacSecretEnv"`  // env var holding the hmac secret, for keyType hmac
+	APIKeys              *APIKeys       `yaml:"apiKeys"`        // for endpoints with auth: apikey
+	Introspection        *Introspection `yaml:"introspection"`  // for endpoints with auth: introspection
+}
+
+// Oauth2 token introspection (rfc 7662) of opaque tokens
+type Introspection struct {
+	URL             string
+	ClientID        string        `yaml:"clientId"`
+	ClientSecret    string        `yaml:"clientSecret" secret:"true"`
+	ClientSecretEnv string        `yaml:"clientSecretEnv"` // env var holding the client secret, in place of clientSecret
+	TimeoutMs       time.Duration `yaml:"timeoutMs"`
+	CacheSize       int           `yaml:"cacheSize"`       // results cached by token hash, -1 disables the cache
+	MaxCacheMs      time.Duration `yaml:"maxCacheMs"`      // the longest an active token is cached, they are also cached no longer than their exp
+	InactiveCacheMs time.Duration `yaml:"inactiveCacheMs"` // how long an inactive token is cached
+}
+
+// Api key authentication. Keys are checked against a store of their hashes
+type APIKeys struct {
+	File       string // the json key store
+	Header     string // the header the key is taken from, defaults to X-API-Key
+	QueryParam string `yaml:"queryParam"` // optional query param the key is taken from, when not in the header
+}
+
+// A json web key set to verify tokens with, keys are selected by the token's kid
+type JWKS struct {
+	File              string        // a local jwks file, ie for tests or keys distributed by config management
+	URL               string        // a jwks url, ie the identity provider's jwks_uri
+	RefreshIntervalMs time.Duration `yaml:"refreshIntervalMs"`
+	TimeoutMs         time.Duration `yaml:"timeoutMs"` // for fetching from the url
+}
+
+// Validation of jwt tokens beyond their signature
+type JWT struct {
+	Algorithms     []string      // allowed signing algorithms, ie RS256, ES256, PS256. defaults to the one of the key type, ie RS256
+	Issuer         string        // required iss, when set
+	Audience       string        // required aud, when set
+	RequiredClaims []string      `yaml:"requiredClaims"`
+	LeewayMs       time.Duration `yaml:"leewayMs"`  // allowed clock skew when checking exp, nbf and iat
+	CacheSize      int           `yaml:"cacheSize"` // verified tokens cached by token hash until their exp, -1 disables the cache
+}
+
+// The admin listener, for /metrics and the admin api. It is kept off the gateway's port so it needn't be
+// exposed with it. When a token is set, requests must carry it as a bearer token
+type Admin struct {
+	Port     int
+	Token    string `secret:"true"`
+	TokenEnv string `yaml:"tokenEnv"` // env var holding the token, in place of token
 }
 
 type Logger struct {
@@ -51,22 +262,145 @@ type Logger struct {
 	File  string
 }
 
+// One line per request, written to its own file. Responses with a 5xx status are logged regardless of sampling
+type AccessLog struct {
+	File         string   // defaults to stdout
+	Format       string   // json or combined, defaults to json
+	SampleRate   float64  `yaml:"sampleRate"`   // the fraction of requests logged, defaults to 1
+	ExcludePaths []string `yaml:"excludePaths"` // path prefixes which aren't logged, ie /health
+}
+
 type Config struct {
 	Gateway        Gateway
 	Endpoints      []Endpoint
 	Server         Server
 	Proxy          Proxy
 	CircuitBreaker *CircuitBreaker `yaml:"circuitBreaker"`
+	RateLimit      *RateLimit      `yaml:"rateLimit"` // optional limit on each client across all endpoints, on top of theirs
 	Logger         *Logger
+	AccessLog      *AccessLog `yaml:"accessLog"` // optional, no access log when not set
+	Admin          *Admin     // optional, no admin listener when not set
+	Path           string     `yaml:"-"` // path of the config file, when loaded from the filesystem
+	Dir            string     `yaml:"-"` // directory of the config file, when loaded from the filesystem
 }
 
 // copy an endpoint
 func (ep *Endpoint) Copy() *Endpoint {
-	return &Endpoint{ep.Name, ep.Key, ep.URL, ep.Authenticate, ep.SharedTransport}
+	c := *ep
+	return &c
+}
+
+// the endpoint's upstreams, a single url is treated as one upstream
+func (ep *Endpoint) Upstreams() []Upstream {
+	if len(ep.URLs) == 0 {
+		return []Upstream{{URL: ep.URL, Weight: 1}}
+	}
+
+	upstreams := make([]Upstream, len(ep.URLs))
+	for i, u := range ep.URLs {
+		upstreams[i] = u
+		if upstreams[i].Weight == 0 {
+			upstreams[i].Weight = 1
+		}
+	}
+	return upstreams
+}
+
+// The auth schemes an endpoint accepts, in the order they are tried. Configured as a single
+// scheme or a list
+type AuthSchemes []string
+
+func (schemes *AuthSchemes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var scheme string
+	if err := unmarshal(&scheme); nil == err {
+		*schemes = AuthSchemes{scheme}
+		return nil
+	}
+
+	var list []string
+	if err := unmarshal(&list); nil != err {
+		return err
+	}
+	*schemes = list
+	return nil
+}
+
+// whether the schemes include the scheme
+func (schemes AuthSchemes) Has(scheme string) bool {
+	for _, s := range schemes {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// the endpoint's authentication schemes, from auth or else the authenticate flag
+func (ep *Endpoint) AuthSchemes() AuthSchemes {
+	if len(ep.Auth) > 0 {
+		return ep.Auth
+	}
+	if ep.Authenticate {
+		return AuthSchemes{AuthJWT}
+	}
+	return AuthSchemes{AuthNone}
+}
+
+// whether requests to the endpoint are authenticated
+func (ep *Endpoint) Authenticated() bool {
+	return !ep.AuthSchemes().Has(AuthNone)
+}
+
+// the endpoint's load balancing strategy
+func (ep *Endpoint) BalanceStrategy() string {
+	if nil == ep.LoadBalancer || ep.LoadBalancer.Strategy == "" {
+		return BalanceRoundRobin
+	}
+	return ep.LoadBalancer.Strategy
+}
+
+// the name of the transport the endpoint uses, which may be shared with other endpoints
+func (ep *Endpoint) TransportName() string {
+	if ep.SharedTransport != "" {
+		return ep.SharedTransport
+	}
+	return ep.Name
+}
+
+// the proxy config for the endpoint, its overrides merged over the global config
+func (ep *Endpoint) MergedProxy(global Proxy) Proxy {
+	if nil != ep.Proxy {
+		mergeOverrides(&global, ep.Proxy)
+	}
+	return global
+}
+
+// the circuit breaker config for the endpoint, its overrides merged over the global config.
+// Nil when neither the endpoint nor the global config has a circuit breaker
+func (ep *Endpoint) MergedCircuitBreaker(global *CircuitBreaker) *CircuitBreaker {
+	if nil == ep.CircuitBreaker {
+		return global
+	}
+
+	merged := new(CircuitBreaker)
+	if nil != global {
+		*merged = *global
+	}
+	mergeOverrides(merged, ep.CircuitBreaker)
+	merged.setDefaults()
+
+	return merged
 }
 
 // to string method for an endpoint
 func (ep Endpoint) String() string {
+	if len(ep.URLs) > 0 {
+		urls := make([]string, len(ep.URLs))
+		for i, u := range ep.URLs {
+			urls[i] = u.URL
+		}
+		return fmt.Sprintf("endpoint [name: %v, key: %v, urls: %v, strategy: %v]", ep.Name, ep.Key, urls, ep.BalanceStrategy())
+	}
 	return fmt.Sprintf("endpoint [name: %v, key: %v, url: %v]", ep.Name, ep.Key, ep.URL)
 }
 
@@ -78,9 +412,144 @@ func (ep *Endpoint) valid() (bool, error) {
 	if ep.Key == "" {
 		return false, errors.New("missing key for endpoint: " + ep.Name)
 	}
-	if ep.URL == "" {
+	if ep.URL == "" && len(ep.URLs) == 0 {
 		return false, errors.New("missing url for endpoint: " + ep.Name)
 	}
+	if ep.URL != "" && len(ep.URLs) > 0 {
+		return false, errors.New("endpoint: " + ep.Name + " may set url or urls, but not both")
+	}
+	for _, u := range ep.URLs {
+		if u.URL == "" {
+			return false, errors.New("missing url in urls for endpoint: " + ep.Name)
+		}
+		if u.Weight < 0 {
+			return false, errors.New(fmt.Sprintf("negative weight for url: %v, endpoint: %v", u.URL, ep.Name))
+		}
+	}
+
+	if nil != ep.LoadBalancer {
+		switch ep.LoadBalancer.Strategy {
+		case "", BalanceRoundRobin, BalanceWeighted, BalanceLeastRequests:
+		case BalanceConsistentHash:
+			if ep.LoadBalancer.HashHeader == "" && ep.LoadBalancer.HashCookie == "" {
+				return false, errors.New("consistentHash needs a hashHeader or hashCookie for endpoint: " + ep.Name)
+			}
+		default:
+			return false, errors.New(fmt.Sprintf("unknown load balancer strategy: '%v' for endpoint: %v", ep.LoadBalancer.Strategy, ep.Name))
+		}
+	}
+
+	if nil != ep.HealthCheck && !strings.HasPrefix(ep.HealthCheck.Path, "/") {
+		return false, errors.New(fmt.Sprintf("health check path: '%v' must start with / for endpoint: %v", ep.HealthCheck.Path, ep.Name))
+	}
+
+	if nil != ep.Retry && (ep.Retry.Attempts < 0 || ep.Retry.BudgetPercent < 0 || ep.Retry.BudgetPercent > 100) {
+		return false, errors.New("retry attempts must be positive and budgetPercent between 0 and 100 for endpoint: " + ep.Name)
+	}
+
+	// schemes other than the built in ones are checked against the registered handlers when routes are built
+	seenSchemes := make(map[string]bool)
+	for _, scheme := range ep.Auth {
+		if scheme == "" {
+			return false, errors.New("empty auth scheme for endpoint: " + ep.Name)
+		}
+		if seenSchemes[scheme] {
+			return false, errors.New(fmt.Sprintf("auth scheme: %v is listed twice for endpoint: %v", scheme, ep.Name))
+		}
+		seenSchemes[scheme] = true
+	}
+	if ep.Auth.Has(AuthNone) && (len(ep.Auth) > 1 || ep.Authenticate) {
+		return false, errors.New("auth none cannot be combined with other schemes for endpoint: " + ep.Name)
+	}
+
+	if len(ep.ClaimHeaders) > 0 && !ep.Authenticated() {
+		return false, errors.New("claimHeaders requires authentication for endpoint: " + ep.Name)
+	}
+
+	if len(ep.Authorize) > 0 && !ep.Authenticated() {
+		return false, errors.New("authorize requires authentication for endpoint: " + ep.Name)
+	}
+
+	if nil != ep.Concurrency {
+		if v, err := ep.Concurrency.valid(); !v {
+			return v, errors.New(fmt.Sprintf("invalid concurrency for endpoint: %v, %v", ep.Name, err))
+		}
+	}
+
+	if nil != ep.RateLimit {
+		if v, err := ep.RateLimit.valid(); !v {
+			return v, errors.New(fmt.Sprintf("invalid rateLimit for endpoint: %v, %v", ep.Name, err))
+		}
+		if key := ep.RateLimit.Key; (key == RateLimitSub || key == RateLimitAPIKey) && !ep.Authenticated() {
+			return false, errors.New(fmt.Sprintf("rateLimit key: %v requires authentication for endpoint: %v", key, ep.Name))
+		}
+	}
+
+	if nil != ep.Match {
+		if v, err := ep.Match.valid(); !v {
+			return v, errors.New(fmt.Sprintf("invalid match for endpoint: %v, %v", ep.Name, err))
+		}
+	}
+
+	for _, rule := range ep.Rewrite {
+		if _, err := regexp.Compile(rule.Match); nil != err {
+			return false, errors.New(fmt.Sprintf("invalid rewrite match: '%v' for endpoint: %v, %v", rule.Match, ep.Name, err))
+		}
+	}
+
+	return true, nil
+}
+
+// validates the concurrency limit, before defaults are set
+func (c *Concurrency) valid() (bool, error) {
+	if c.Max <= 0 {
+		return false, errors.New("max must be positive")
+	}
+	if c.QueueDepth < 0 {
+		return false, errors.New("queueDepth can't be negative")
+	}
+
+	if a := c.Adaptive; nil != a {
+		switch a.Algorithm {
+		case "", LimitAIMD, LimitGradient:
+		default:
+			return false, errors.New(fmt.Sprintf("unknown adaptive algorithm: '%v'", a.Algorithm))
+		}
+		if a.MinLimit < 0 || (a.MaxLimit > 0 && a.MaxLimit < a.MinLimit) {
+			return false, errors.New("adaptive minLimit must be positive, and no more than maxLimit")
+		}
+		if a.MaxLimit > 0 && c.Max > a.MaxLimit {
+			return false, errors.New("max, the initial limit, can't be more than the adaptive maxLimit")
+		}
+		if a.BackoffRatio < 0 || a.BackoffRatio >= 1 || a.Smoothing < 0 || a.Smoothing > 1 {
+			return false, errors.New("adaptive backoffRatio and smoothing must be between 0 and 1")
+		}
+	}
+
+	return true, nil
+}
+
+// validates a rate limit, before defaults are set
+func (rl *RateLimit) valid() (bool, error) {
+	if rl.RequestsPerSecond <= 0 {
+		return false, errors.New("requestsPerSecond must be positive")
+	}
+	if rl.Burst < 0 {
+		return false, errors.New("burst can't be negative")
+	}
+
+	switch rl.Key {
+	case "", RateLimitIP, RateLimitSub, RateLimitAPIKey:
+		if rl.Header != "" {
+			return false, errors.New("header is only used with key: header")
+		}
+	case RateLimitHeader:
+		if rl.Header == "" {
+			return false, errors.New("key: header must set a header")
+		}
+	default:
+		return false, errors.New(fmt.Sprintf("unknown key: '%v'", rl.Key))
+	}
 
 	return true, nil
 }
@@ -110,6 +579,61 @@ func (config *Config) validateEndpoints() (bool, error) {
 		}
 	}
 
+	return config.validateRoutes()
+}
+
+// validates the circuit breaker configuration, after defaults are set
+func (cb *CircuitBreaker) valid() (bool, error) {
+	switch cb.TripPolicy {
+	case TripConsecutiveFailures:
+		if cb.FailuresToOpen < 0 {
+			return false, errors.New("circuit breaker failuresToOpen must be positive")
+		}
+	case TripFailureRatio:
+		if cb.FailureRatio <= 0 || cb.FailureRatio > 1 {
+			return false, errors.New(fmt.Sprintf("circuit breaker failureRatio: %v must be between 0 and 1", cb.FailureRatio))
+		}
+	case TripSlowCallRatio:
+		if cb.SlowCallRatio <= 0 || cb.SlowCallRatio > 1 {
+			return false, errors.New(fmt.Sprintf("circuit breaker slowCallRatio: %v must be between 0 and 1", cb.SlowCallRatio))
+		}
+	default:
+		return false, errors.New(fmt.Sprintf("unknown circuit breaker tripPolicy: '%v'", cb.TripPolicy))
+	}
+
+	return true, nil
+}
+
+// validates the merged per-endpoint settings. Endpoints which share a transport share its settings,
+// so their overrides must agree
+func (config *Config) validateEndpointOverrides() (bool, error) {
+	type transportSettings struct {
+		endpoint       string
+		proxy          Proxy
+		circuitBreaker *CircuitBreaker
+	}
+	transports := make(map[string]transportSettings)
+
+	for _, ep := range config.Endpoints {
+		settings := transportSettings{ep.Name, ep.MergedProxy(config.Proxy), ep.MergedCircuitBreaker(config.CircuitBreaker)}
+
+		if nil != settings.circuitBreaker {
+			if v, err := settings.circuitBreaker.valid(); !v {
+				return v, errors.New(fmt.Sprintf("endpoint: '%v' %v", ep.Name, err))
+			}
+		}
+
+		transName := ep.TransportName()
+		if other, ok := transports[transName]; ok {
+			if !reflect.DeepEqual(other.proxy, settings.proxy) || !reflect.DeepEqual(other.circuitBreaker, settings.circuitBreaker) {
+				return false, errors.New(fmt.Sprintf("endpoints: '%v' and '%v' share transport: '%v' but have conflicting overrides",
+					other.endpoint, ep.Name, transName))
+			}
+		} else {
+			transports[transName] = settings
+		}
+	}
+
 	return true, nil
 }
 
@@ -130,8 +654,8 @@ func (config *Config) setServerDefaults() {
 
 // ensure sensible defaults for the proxy
 func (config *Config) setProxyDefaults() {
-	if config.Proxy.DialKeepAliveMs == 0 {
-		config.Proxy.DialKeepAliveMs = 10000
+	if config.Proxy.DialTimeoutMs == 0 {
+		config.Proxy.DialTimeoutMs = 10000
 	}
 	if config.Proxy.DialKeepAliveMs == 0 {
 		config.Proxy.DialKeepAliveMs = 10000
@@ -158,17 +682,142 @@ func (config *Config) setProxyDefaults() {
 
 // ensure sensible defaults for the circuit breaker
 func (config *Config) setCircuitBreakerDefaults() {
-	if config.CircuitBreaker.MaxHalfOpenRequests == 0 {
-		config.CircuitBreaker.MaxHalfOpenRequests = 1
+	if nil == config.CircuitBreaker {
+		return // no circuit breaker configured
+	}
+	config.CircuitBreaker.setDefaults()
+}
+
+func (cb *CircuitBreaker) setDefaults() {
+	if cb.MaxHalfOpenRequests == 0 {
+		cb.MaxHalfOpenRequests = 1
+	}
+	if cb.ClearFailureCountIntervalMs == 0 {
+		cb.ClearFailureCountIntervalMs = 10000
+	}
+	if cb.HalfOpenAfterMs == 0 {
+		cb.HalfOpenAfterMs = 5000
+	}
+	if cb.FailuresToOpen == 0 {
+		cb.FailuresToOpen = 10
+	}
+	if cb.TripPolicy == "" {
+		cb.TripPolicy = TripConsecutiveFailures
+	}
+	if cb.MinRequests == 0 {
+		cb.MinRequests = 20
+	}
+	if cb.FailureRatio == 0 {
+		cb.FailureRatio = 0.5
+	}
+	if cb.SlowCallMs == 0 {
+		cb.SlowCallMs = 1000
+	}
+	if cb.SlowCallRatio == 0 {
+		cb.SlowCallRatio = 0.5
+	}
+}
+
+// ensure sensible defaults for the endpoints
+func (config *Config) setEndpointDefaults() {
+	for _, ep := range config.Endpoints {
+		if nil != ep.HealthCheck {
+			ep.HealthCheck.setDefaults()
+		}
+		if nil != ep.Retry {
+			ep.Retry.setDefaults()
+		}
+		if nil != ep.Concurrency {
+			ep.Concurrency.setDefaults()
+		}
+		if nil != ep.RateLimit {
+			ep.RateLimit.setDefaults()
+		}
+	}
+}
+
+// ensure sensible defaults for the global rate limit
+func (config *Config) setRateLimitDefaults() {
+	if nil == config.RateLimit {
+		return // no global rate limit configured
+	}
+	config.RateLimit.setDefaults()
+}
+
+func (rl *RateLimit) setDefaults() {
+	if rl.Burst == 0 {
+		rl.Burst = int(math.Ceil(rl.RequestsPerSecond))
+	}
+	if rl.Key == "" {
+		rl.Key = RateLimitIP
+	}
+}
+
+func (c *Concurrency) setDefaults() {
+	if c.QueueDepth > 0 && c.QueueTimeoutMs == 0 {
+		c.QueueTimeoutMs = 1000
+	}
+
+	a := c.Adaptive
+	if nil == a {
+		return
+	}
+	if a.Algorithm == "" {
+		a.Algorithm = LimitAIMD
+	}
+	if a.MinLimit == 0 {
+		a.MinLimit = 1
+	}
+	if a.MaxLimit == 0 {
+		a.MaxLimit = 10 * c.Max
+		if a.MaxLimit < a.MinLimit {
+			a.MaxLimit = a.MinLimit
+		}
+	}
+	if a.LatencyThresholdMs == 0 {
+		a.LatencyThresholdMs = 1000
+	}
+	if a.BackoffRatio == 0 {
+		a.BackoffRatio = 0.9
+	}
+	if a.Smoothing == 0 {
+		a.Smoothing = 0.2
+	}
+}
+
+func (retry *Retry) setDefaults() {
+	if retry.Attempts == 0 {
+		retry.Attempts = 2
+	}
+	if retry.BaseBackoffMs == 0 {
+		retry.BaseBackoffMs = 25
+	}
+	if retry.MaxBackoffMs == 0 {
+		retry.MaxBackoffMs = 250
+	}
+	if retry.BudgetPercent == 0 {
+		retry.BudgetPercent = 20
+	}
+	if retry.MinRetriesPerSec == 0 {
+		retry.MinRetriesPerSec = 10
 	}
-	if config.CircuitBreaker.ClearFailureCountIntervalMs == 0 {
-		config.CircuitBreaker.ClearFailureCountIntervalMs = 10000
+}
+
+func (hc *HealthCheck) setDefaults() {
+	if hc.IntervalMs == 0 {
+		hc.IntervalMs = 10000
+	}
+	if hc.TimeoutMs == 0 {
+		hc.TimeoutMs = 1000
 	}
-	if config.CircuitBreaker.HalfOpenAfterMs == 0 {
-		config.CircuitBreaker.HalfOpenAfterMs = 5000
+	if hc.HealthyThreshold == 0 {
+		hc.HealthyThreshold = 2
 	}
-	if config.CircuitBreaker.FailuresToOpen == 0 {
-		config.CircuitBreaker.FailuresToOpen = 10
+	if hc.UnhealthyThreshold == 0 {
+		hc.UnhealthyThreshold = 3
+	}
+	if hc.ExpectedStatus == 0 {
+		hc.ExpectedStatus = 200
 	}
 }
 
@@ -177,6 +826,43 @@ func (config *Config) setGatewayDefaults() {
 	if config.Gateway.AuthWorkers == 0 {
 		config.Gateway.AuthWorkers = 4
 	}
+	if config.Gateway.AuthQueueDepth == 0 {
+		config.Gateway.AuthQueueDepth = 1000
+	}
+	if config.Gateway.AuthQueueTimeoutMs == 0 {
+		config.Gateway.AuthQueueTimeoutMs = 1000
+	}
+	if config.Gateway.ConfigPollIntervalMs == 0 {
+		config.Gateway.ConfigPollIntervalMs = 5000
+	}
+	if nil != config.Gateway.APIKeys && config.Gateway.APIKeys.Header == "" {
+		config.Gateway.APIKeys.Header = "X-API-Key"
+	}
+	if config.Gateway.JWT.CacheSize == 0 {
+		config.Gateway.JWT.CacheSize = 10000
+	}
+	if introspection := config.Gateway.Introspection; nil != introspection {
+		if introspection.TimeoutMs == 0 {
+			introspection.TimeoutMs = 2000
+		}
+		if introspection.CacheSize == 0 {
+			introspection.CacheSize = 10000
+		}
+		if introspection.MaxCacheMs == 0 {
+			introspection.MaxCacheMs = 300000
+		}
+		if introspection.InactiveCacheMs == 0 {
+			introspection.InactiveCacheMs = 30000
+		}
+	}
+	if nil != config.Gateway.JWKS {
+		if config.Gateway.JWKS.RefreshIntervalMs == 0 {
+			config.Gateway.JWKS.RefreshIntervalMs = 300000
+		}
+		if config.Gateway.JWKS.TimeoutMs == 0 {
+			config.Gateway.JWKS.TimeoutMs = 5000
+		}
+	}
 }
 
 func (config *Config) setLoggerDefaults() {
@@ -185,6 +871,15 @@ func (config *Config) setLoggerDefaults() {
 	} else if config.Logger.Level == "" {
 		config.Logger.Level = defaultLoglevel
 	}
+
+	if accessLog := config.AccessLog; nil != accessLog {
+		if accessLog.Format == "" {
+			accessLog.Format = "json"
+		}
+		if accessLog.SampleRate == 0 {
+			accessLog.SampleRate = 1
+		}
+	}
 }
 
 // parses the config file
@@ -199,12 +894,114 @@ func Parse(ctnt []byte) (*Config, error) {
 	if v, err := c.validateEndpoints(); !v {
 		return nil, err
 	}
+	if nil != c.RateLimit {
+		if v, err := c.RateLimit.valid(); !v {
+			return nil, errors.New(fmt.Sprintf("invalid rateLimit, %v", err))
+		}
+	}
 
 	c.setServerDefaults()
+	c.setEndpointDefaults()
 	c.setProxyDefaults()
 	c.setCircuitBreakerDefaults()
+	c.setRateLimitDefaults()
 	c.setGatewayDefaults()
 	c.setLoggerDefaults()
 
+	if nil != c.CircuitBreaker {
+		if v, err := c.CircuitBreaker.valid(); !v {
+			return nil, err
+		}
+	}
+
+	if nil != c.Gateway.JWKS && (c.Gateway.JWKS.File == "") == (c.Gateway.JWKS.URL == "") {
+		return nil, errors.New("gateway jwks must set one of file or url")
+	}
+
+	switch c.Gateway.KeyType {
+	case "", "rsa", "ec":
+	case "hmac":
+		if nil != c.Gateway.JWKS {
+			return nil, errors.New("gateway keyType hmac can't be used with a jwks")
+		}
+		if (c.Gateway.HMACSecretFile == "") == (c.Gateway.HMACSecretEnv == "") {
+			return nil, errors.New("gateway keyType hmac must set one of hmacSecretFile or hmacSecretEnv")
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown gateway keyType: '%v'", c.Gateway.KeyType))
+	}
+
+	if nil != c.AccessLog {
+		if c.AccessLog.Format != "json" && c.AccessLog.Format != "combined" {
+			return nil, errors.New(fmt.Sprintf("unknown accessLog format: '%v'", c.AccessLog.Format))
+		}
+		if c.AccessLog.SampleRate < 0 || c.AccessLog.SampleRate > 1 {
+			return nil, errors.New("accessLog sampleRate must be between 0 and 1")
+		}
+	}
+
+	if nil != c.Admin && (c.Admin.Port <= 0 || c.Admin.Port == c.Server.Port) {
+		return nil, errors.New("admin must set a port other than the server port")
+	}
+	if nil != c.Admin && c.Admin.Token != "" && c.Admin.TokenEnv != "" {
+		return nil, errors.New("admin can't set both token and tokenEnv")
+	}
+
+	if nil != c.Gateway.APIKeys && c.Gateway.APIKeys.File == "" {
+		return nil, errors.New("gateway apiKeys must set a file")
+	}
+	if nil != c.Gateway.Introspection && c.Gateway.Introspection.URL == "" {
+		return nil, errors.New("gateway introspection must set a url")
+	}
+	for _, ep := range c.Endpoints {
+		if ep.AuthSchemes().Has(AuthAPIKey) && nil == c.Gateway.APIKeys {
+			return nil, errors.New("endpoint: " + ep.Name + " uses auth apikey but gateway apiKeys is not configured")
+		}
+		if ep.AuthSchemes().Has(AuthIntrospection) && nil == c.Gateway.Introspection {
+			return nil, errors.New("endpoint: " + ep.Name + " uses auth introspection but gateway introspection is not configured")
+		}
+	}
+
+	if v, err := c.validateEndpointOverrides(); !v {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// parses a config file from the filesystem, falling back to the compiled-in assets
+func ParseFile(path string) (*Config, error) {
+	ctnt, err := ReadResource(path)
+	if nil != err {
+		return nil, err
+	}
+
+	c, err := Parse(ctnt)
+	if nil != err {
+		return nil, err
+	}
+
+	if _, err := os.Stat(path); nil == err {
+		c.Path = path
+		c.Dir = filepath.Dir(path)
+	}
+
 	return c, nil
 }
+
+// copies each non-zero field of the override struct over the same field of dst, both must be
+// pointers to the same struct type
+func mergeOverrides(dst interface{}, override interface{}) {
+	dv := reflect.ValueOf(dst).Elem()
+	ov := reflect.ValueOf(override).Elem()
+
+	for i := 0; i < ov.NumField(); i++ {
+		if f := ov.Field(i); !isZero(f) {
+			dv.Field(i).Set(f)
+		}
+	}
+}
+
+func isZero(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
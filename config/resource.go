@@ -0,0 +1,44 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/seansitter/gogw/res"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Reads a resource (ie config or pem file) from the filesystem, falling back to the
+// compiled-in assets when the path does not exist on disk
+func ReadResource(path string) ([]byte, error) {
+	ctnt, err := ioutil.ReadFile(path)
+	if nil == err {
+		return ctnt, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, errors.New(fmt.Sprintf("failed to read resource: %v, %v", path, err))
+	}
+
+	ctnt, err = res.Asset(path)
+	if nil != err {
+		return nil, errors.New(fmt.Sprintf("resource: %v not found on filesystem or in assets", path))
+	}
+
+	return ctnt, nil
+}
+
+// Resolves a path referenced from the config. Relative paths are first tried against the
+// directory of the config file (when it was loaded from disk), then used as is
+func (config *Config) ResolvePath(path string) string {
+	if path == "" || filepath.IsAbs(path) || config.Dir == "" {
+		return path
+	}
+
+	relPath := filepath.Join(config.Dir, path)
+	if _, err := os.Stat(relPath); nil == err {
+		return relPath
+	}
+
+	return path
+}
@@ -0,0 +1,191 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Determines which requests are routed to an endpoint. All of the configured predicates must match.
+type RouteMatch struct {
+	Hosts   []string          // exact hosts, or wildcards such as *.example.com. empty matches any host
+	Path    string            // path prefix, segments may be templates such as {id} which capture a single segment
+	Methods []string          // empty matches any method
+	Headers map[string]string // headers which must be present, with the given value unless it is empty
+	Query   map[string]string // query params which must be present, with the given value unless it is empty
+}
+
+// the route match for the endpoint, endpoints without one are matched on the path prefix /<name>
+func (ep *Endpoint) RouteMatch() RouteMatch {
+	if nil == ep.Match {
+		return RouteMatch{Path: "/" + ep.Name}
+	}
+
+	m := *ep.Match
+	if m.Path == "" {
+		m.Path = "/"
+	}
+	return m
+}
+
+// splits a path into its non-empty segments
+func PathSegments(path string) []string {
+	segments := make([]string, 0)
+	for _, s := range strings.Split(path, "/") {
+		if s != "" {
+			segments = append(segments, s)
+		}
+	}
+	return segments
+}
+
+// whether a path segment is a template, ie {id}
+func IsTemplateSegment(segment string) bool {
+	return len(segment) > 2 && strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+// validates a single route match
+func (m *RouteMatch) valid() (bool, error) {
+	if m.Path != "" && !strings.HasPrefix(m.Path, "/") {
+		return false, errors.New(fmt.Sprintf("path: '%v' must start with /", m.Path))
+	}
+
+	for _, s := range PathSegments(m.Path) {
+		if strings.ContainsAny(s, "{}") && !IsTemplateSegment(s) {
+			return false, errors.New(fmt.Sprintf("path: '%v' has a malformed template segment: '%v'", m.Path, s))
+		}
+	}
+
+	for _, h := range m.Hosts {
+		if strings.Contains(strings.TrimPrefix(h, "*."), "*") {
+			return false, errors.New(fmt.Sprintf("host: '%v' may only have a leading wildcard", h))
+		}
+	}
+
+	return true, nil
+}
+
+// template segments of a normalized path, whatever they were named
+const normalizedTemplate = "{}"
+
+// the match with template names, case and ordering normalized, so that two matches which would
+// accept exactly the same requests at the same priority compare equal
+func (m RouteMatch) normalized() RouteMatch {
+	n := RouteMatch{Headers: make(map[string]string), Query: make(map[string]string)}
+
+	segments := PathSegments(m.Path)
+	for i, s := range segments {
+		if IsTemplateSegment(s) {
+			segments[i] = normalizedTemplate
+		}
+	}
+	n.Path = "/" + strings.Join(segments, "/")
+
+	for _, h := range m.Hosts {
+		n.Hosts = append(n.Hosts, strings.ToLower(h))
+	}
+	sort.Strings(n.Hosts)
+
+	for _, method := range m.Methods {
+		n.Methods = append(n.Methods, strings.ToUpper(method))
+	}
+	sort.Strings(n.Methods)
+
+	for k, v := range m.Headers {
+		n.Headers[http.CanonicalHeaderKey(k)] = v
+	}
+	for k, v := range m.Query {
+		n.Query[k] = v
+	}
+
+	return n
+}
+
+// whether two lists share an entry
+func overlaps(a []string, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// whether a request could satisfy both sets of predicates, they conflict when a key requires different values
+func compatible(a map[string]string, b map[string]string) bool {
+	for k, v := range a {
+		if w, ok := b[k]; ok && v != "" && w != "" && v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// whether two normalized paths have the same priority and could match the same request path. Paths are
+// prioritized by their number of segments, then their number of literal segments. Compared segment by segment,
+// a template matches any literal, so /{}/b and /a/{} both match /a/b
+func pathsOverlap(a string, b string) bool {
+	as, bs := PathSegments(a), PathSegments(b)
+	if len(as) != len(bs) {
+		return false
+	}
+
+	aLiterals, bLiterals := 0, 0
+	for i := range as {
+		aTemplate, bTemplate := as[i] == normalizedTemplate, bs[i] == normalizedTemplate
+		if !aTemplate {
+			aLiterals++
+		}
+		if !bTemplate {
+			bLiterals++
+		}
+		if !aTemplate && !bTemplate && as[i] != bs[i] {
+			return false
+		}
+	}
+
+	return aLiterals == bLiterals
+}
+
+// whether two normalized matches could accept the same request with the same priority. Routes are prioritized
+// by host, then path, then whether they filter on method, then by the number of header and query predicates
+func ambiguous(a RouteMatch, b RouteMatch) bool {
+	if !pathsOverlap(a.Path, b.Path) {
+		return false
+	}
+	if !(len(a.Hosts) == 0 && len(b.Hosts) == 0) && !overlaps(a.Hosts, b.Hosts) {
+		return false
+	}
+	if !(len(a.Methods) == 0 && len(b.Methods) == 0) && !overlaps(a.Methods, b.Methods) {
+		return false
+	}
+	if len(a.Headers)+len(a.Query) != len(b.Headers)+len(b.Query) {
+		return false
+	}
+
+	return compatible(a.Headers, b.Headers) && compatible(a.Query, b.Query)
+}
+
+// reports routes which could match the same request with the same priority, since the gateway
+// would have no way to choose between them
+func (config *Config) validateRoutes() (bool, error) {
+	matches := make([]RouteMatch, len(config.Endpoints))
+	for i, ep := range config.Endpoints {
+		matches[i] = ep.RouteMatch().normalized()
+	}
+
+	for i := range matches {
+		for j := i + 1; j < len(matches); j++ {
+			if ambiguous(matches[i], matches[j]) {
+				return false, errors.New(fmt.Sprintf("endpoints: '%v' and '%v' have ambiguous routes",
+					config.Endpoints[i].Name, config.Endpoints[j].Name))
+			}
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,48 @@
+package gateway
+
+import (
+	gwlog "github.com/seansitter/gogw/log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// the access log entry for a request, taken before it is handled since stages may change it (ie rewrites).
+// The response fields are filled in once it is done
+func newAccessEntry(r *http.Request, start time.Time) gwlog.AccessEntry {
+	return gwlog.AccessEntry{
+		Time:      start,
+		Method:    r.Method,
+		Path:      r.URL.EscapedPath(),
+		Proto:     r.Proto,
+		ClientIP:  clientIP(r),
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+	}
+}
+
+// the address of the client the request came from, without its port
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); nil == err {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// logs a handled request to the access log
+func (d *Dispatcher) logAccess(entry gwlog.AccessEntry, sw *statusWriter, state *RequestState) {
+	entry.Endpoint = state.Endpoint
+	entry.RequestID = state.RequestID
+	entry.Status = sw.status
+	if entry.Status == 0 {
+		entry.Status = http.StatusOK
+	}
+	entry.Bytes = sw.bytes
+	entry.UpstreamLatency = state.UpstreamLatency
+	entry.Latency = time.Since(entry.Time)
+	if sub, ok := state.Claims["sub"].(string); ok {
+		entry.Subject = sub
+	}
+
+	d.accessLog.Log(entry)
+}
@@ -0,0 +1,236 @@
+package gateway
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/seansitter/gogw/config"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The admin server, on its own port so that it isn't exposed along with the gateway. It serves the metrics
+// and an api for inspecting and controlling routes and circuit breakers:
+//
+//	GET  /routes                          the routes, with their endpoint config, state and upstreams
+//	POST /routes/{drain,disable,enable}   ?endpoint=name
+//	GET  /breakers                        the circuit breaker state and counts of each transport
+//	POST /breakers/{open,reset}           ?transport=name
+//	GET  /config                          the effective config, after defaults, with secrets redacted
+func newAdminServer(s *GwServer) (*http.Server, error) {
+	admin := s.config.Admin
+	token := admin.Token
+	if admin.TokenEnv != "" {
+		if token = os.Getenv(admin.TokenEnv); token == "" {
+			return nil, errors.New("admin token env var: " + admin.TokenEnv + " is empty")
+		}
+	}
+	if token == "" {
+		log.Warn("the admin api has no token, anyone who can reach its port can control the gateway")
+	}
+
+	api := &adminAPI{server: s}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metrics.Handler())
+	mux.HandleFunc("/routes", api.routes)
+	mux.HandleFunc("/routes/", api.routeAction)
+	mux.HandleFunc("/breakers", api.breakers)
+	mux.HandleFunc("/breakers/", api.breakerAction)
+	mux.HandleFunc("/config", api.config)
+
+	return &http.Server{
+		Addr:           ":" + strconv.Itoa(admin.Port),
+		Handler:        requireAdminToken(token, mux),
+		ReadTimeout:    s.config.Server.ReadTimeoutMs * time.Millisecond,
+		WriteTimeout:   s.config.Server.WriteTimeoutMs * time.Millisecond,
+		MaxHeaderBytes: 1 << 20,
+	}, nil
+}
+
+// requires the token as a bearer token, when one is set
+func requireAdminToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gogw-admin"`)
+			writeAdminError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type adminAPI struct {
+	server *GwServer
+}
+
+// A route as the admin api shows it
+type routeInfo struct {
+	Name      string         `json:"name"`
+	State     string         `json:"state"`
+	InFlight  int64          `json:"inFlight"`
+	Endpoint  interface{}    `json:"endpoint"`
+	Upstreams []upstreamInfo `json:"upstreams"`
+}
+
+type upstreamInfo struct {
+	URL         string `json:"url"`
+	Transport   string `json:"transport"`
+	Healthy     bool   `json:"healthy"`
+	Available   bool   `json:"available"`
+	Outstanding int64  `json:"outstanding"`
+}
+
+// A transport's circuit breaker as the admin api shows it
+type breakerInfo struct {
+	Transport  string        `json:"transport"`
+	Configured bool          `json:"configured"` // whether the transport has a breaker, one without may still be forced open
+	State      string        `json:"state"`
+	ForcedOpen bool          `json:"forcedOpen"`
+	Counts     BreakerCounts `json:"counts"`
+}
+
+func (api *adminAPI) routes(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	routes := []routeInfo{}
+	if router := api.server.dispatcher.currentRouter(); nil != router {
+		for _, route := range router.Routes() {
+			info := routeInfo{
+				Name:     route.Endpoint.Name,
+				State:    route.control.State(),
+				InFlight: route.control.InFlight(),
+				Endpoint: config.Export(route.Endpoint),
+			}
+			for _, upstream := range route.Upstreams {
+				info.Upstreams = append(info.Upstreams, upstreamInfo{
+					URL:         config.RedactURL(upstream.URL.String()),
+					Transport:   upstream.Transport.Name,
+					Healthy:     upstream.Healthy(),
+					Available:   upstream.Available(),
+					Outstanding: upstream.Outstanding(),
+				})
+			}
+			routes = append(routes, info)
+		}
+	}
+
+	writeAdminJSON(w, http.StatusOK, routes)
+}
+
+// POST /routes/{drain,disable,enable}?endpoint=name
+func (api *adminAPI) routeAction(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var state string
+	switch strings.TrimPrefix(r.URL.Path, "/routes/") {
+	case "drain":
+		state = RouteDraining
+	case "disable":
+		state = RouteDisabled
+	case "enable":
+		state = RouteActive
+	default:
+		writeAdminError(w, http.StatusNotFound, "unknown route action")
+		return
+	}
+
+	endpoint := r.URL.Query().Get("endpoint")
+	if err := api.server.dispatcher.SetRouteState(endpoint, state); nil != err {
+		writeAdminError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, map[string]string{"endpoint": endpoint, "state": state})
+}
+
+func (api *adminAPI) breakers(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	breakers := []breakerInfo{}
+	for _, transport := range api.server.dispatcher.currentTransports() {
+		breakers = append(breakers, newBreakerInfo(transport))
+	}
+
+	writeAdminJSON(w, http.StatusOK, breakers)
+}
+
+func newBreakerInfo(transport *CbTransport) breakerInfo {
+	return breakerInfo{
+		Transport:  transport.Name,
+		Configured: nil != transport.CircuitBreaker(),
+		State:      transport.BreakerState().String(),
+		ForcedOpen: transport.ForcedOpen(),
+		Counts:     transport.Counts(),
+	}
+}
+
+// POST /breakers/{open,reset}?transport=name
+func (api *adminAPI) breakerAction(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	name := r.URL.Query().Get("transport")
+	transport := api.server.dispatcher.FindTransport(name)
+	if nil == transport {
+		writeAdminError(w, http.StatusNotFound, "no transport: "+name)
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, "/breakers/") {
+	case "open":
+		transport.ForceOpen()
+	case "reset":
+		transport.ResetBreaker()
+	default:
+		writeAdminError(w, http.StatusNotFound, "unknown breaker action")
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, newBreakerInfo(transport))
+}
+
+func (api *adminAPI) config(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, api.server.currentConfig().Redacted())
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return false
+	}
+	return true
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); nil != err {
+		log.Errorf("failed to write admin response: %v", err)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminJSON(w, status, map[string]string{"error": message})
+}
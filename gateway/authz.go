@@ -0,0 +1,156 @@
+package gateway
+
+import (
+	"github.com/seansitter/gogw/auth"
+	"github.com/seansitter/gogw/config"
+	"github.com/seansitter/gogw/httperr"
+	gwlog "github.com/seansitter/gogw/log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Authorizes a request from the claims of the authenticated principal
+type authzRule struct {
+	config.AuthzRule
+	methods map[string]bool
+}
+
+// whether the rule applies to the request
+func (rule *authzRule) appliesTo(r *http.Request) bool {
+	if len(rule.methods) > 0 && !rule.methods[r.Method] {
+		return false
+	}
+	if prefix := strings.TrimSuffix(rule.Path, "/"); prefix != "" {
+		p := rulePath(r)
+		if !strings.HasPrefix(p, prefix) {
+			return false
+		}
+		// the prefix matches whole segments, /admin doesn't cover /administrator
+		if rest := p[len(prefix):]; rest != "" && !strings.HasPrefix(rest, "/") {
+			return false
+		}
+	}
+	return true
+}
+
+// the request's path as the rules see it. empty and dot segments are cleaned out, as an upstream which
+// normalizes the path would, so that they can't be used to step around a rule: /public/../admin is /admin
+func rulePath(r *http.Request) string {
+	return path.Clean("/" + r.URL.Path)
+}
+
+// checks the claims against the rule, returning the reason for a failure
+func (rule *authzRule) check(claims auth.Claims) (bool, string) {
+	if iss, _ := claims["iss"].(string); rule.Issuer != "" && iss != rule.Issuer {
+		return false, "issuer does not match: " + rule.Issuer
+	}
+
+	if rule.Audience != "" && !claimIncludes(claims["aud"], rule.Audience) {
+		return false, "audience does not match: " + rule.Audience
+	}
+
+	if len(rule.Scopes) > 0 {
+		scopes := claimValues(claims["scope"])
+		if len(scopes) == 0 {
+			scopes = claimValues(claims["scp"])
+		}
+		for _, scope := range rule.Scopes {
+			if !contains(scopes, scope) {
+				return false, "missing scope: " + scope
+			}
+		}
+	}
+
+	for claim, allowed := range rule.Claims {
+		ok := false
+		for _, v := range allowed {
+			if claimContains(claims[claim], v) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false, "claim: " + claim + " is not one of: " + strings.Join(allowed, ", ")
+		}
+	}
+
+	return true, ""
+}
+
+// the string values of a claim, lists and space delimited strings (ie scopes) are split
+func claimValues(claim interface{}) []string {
+	switch cv := claim.(type) {
+	case nil:
+		return nil
+	case string:
+		return strings.Fields(cv)
+	case []interface{}:
+		vals := make([]string, 0, len(cv))
+		for _, v := range cv {
+			vals = append(vals, claimString(v))
+		}
+		return vals
+	default:
+		return []string{claimString(cv)}
+	}
+}
+
+// whether a claim equals, or for a list contains, the value
+func claimContains(claim interface{}, value string) bool {
+	if s, ok := claim.(string); ok && s == value {
+		return true
+	}
+	return contains(claimValues(claim), value)
+}
+
+// whether a claim equals the value, or for a list has it as an element. unlike claimContains strings aren't
+// split, so a claim of "a b" includes neither a nor b
+func claimIncludes(claim interface{}, value string) bool {
+	switch cv := claim.(type) {
+	case string:
+		return cv == value
+	case []string:
+		return contains(cv, value)
+	case []interface{}:
+		for _, v := range cv {
+			if s, ok := v.(string); ok && s == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Creates a StageHandler which authorizes the request from the claims set by the auth stage
+func (d *Dispatcher) newAuthzStageHandler(ep config.Endpoint, next *StageHandler) *StageHandler {
+	rules := make([]authzRule, len(ep.Authorize))
+	for i, rule := range ep.Authorize {
+		rules[i] = authzRule{rule, make(map[string]bool)}
+		for _, m := range rule.Methods {
+			rules[i].methods[strings.ToUpper(m)] = true
+		}
+	}
+
+	return &StageHandler{
+		Next: next,
+		ExecHandler: func(w http.ResponseWriter, r *http.Request) bool {
+			var claims auth.Claims
+			if state := GetRequestState(r); nil != state {
+				claims = state.Claims
+			}
+
+			for _, rule := range rules {
+				if !rule.appliesTo(r) {
+					continue
+				}
+				if ok, reason := rule.check(claims); !ok {
+					gwlog.FromContext(r.Context()).Infof("forbidden %v %v for endpoint: %v, %v", r.Method, r.URL.Path, ep.Name, reason)
+					d.sendError(w, httperr.Forbidden)
+					return false
+				}
+			}
+			return true
+		},
+	}
+}
@@ -0,0 +1,77 @@
+package gateway
+
+import (
+	"github.com/seansitter/gogw/auth"
+	"github.com/seansitter/gogw/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthzIssuer(t *testing.T) {
+	rule := authzRule{AuthzRule: config.AuthzRule{Issuer: "https://trusted"}}
+
+	tests := []struct {
+		iss     interface{}
+		allowed bool
+	}{
+		{"https://trusted", true},
+		{"https://evil https://trusted", false}, // the issuer isn't split on spaces
+		{"https://trusted ", false},
+		{[]interface{}{"https://trusted"}, false}, // iss is a single string
+		{nil, false},
+	}
+	for _, test := range tests {
+		if ok, _ := rule.check(auth.Claims{"iss": test.iss}); ok != test.allowed {
+			t.Errorf("iss: %#v, expected allowed: %v, got: %v", test.iss, test.allowed, ok)
+		}
+	}
+}
+
+func TestAuthzAudience(t *testing.T) {
+	rule := authzRule{AuthzRule: config.AuthzRule{Audience: "api"}}
+
+	tests := []struct {
+		aud     interface{}
+		allowed bool
+	}{
+		{"api", true},
+		{[]interface{}{"other", "api"}, true},
+		{[]string{"api"}, true},
+		{"other api", false}, // the audience isn't split on spaces
+		{[]interface{}{"other api"}, false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		if ok, _ := rule.check(auth.Claims{"aud": test.aud}); ok != test.allowed {
+			t.Errorf("aud: %#v, expected allowed: %v, got: %v", test.aud, test.allowed, ok)
+		}
+	}
+}
+
+func TestAuthzRulePath(t *testing.T) {
+	rule := authzRule{AuthzRule: config.AuthzRule{Path: "/admin"}}
+
+	tests := []struct {
+		path    string
+		applies bool
+	}{
+		{"/admin", true},
+		{"/admin/", true},
+		{"/admin/users", true},
+		{"/public/../admin/users", true},
+		{"//admin/users", true},
+		{"/./admin", true},
+		{"/public/..//admin", true},
+		{"/administrator", false},
+		{"/public", false},
+		{"/admin/../public", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.URL.Path = test.path
+		if applies := rule.appliesTo(r); applies != test.applies {
+			t.Errorf("path: %v, expected the rule to apply: %v, got: %v", test.path, test.applies, applies)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package gateway
+
+import (
+	"fmt"
+	"github.com/seansitter/gogw/config"
+	"github.com/sony/gobreaker"
+	"hash/crc32"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// number of points each upstream gets on the consistent hash ring
+const hashRingReplicas = 100
+
+// the health of an upstream, as set by active health checks
+const (
+	upstreamHealthy   int32 = iota
+	upstreamUnhealthy       // failed its checks, out of rotation until it passes enough of them
+	upstreamUnchecked       // new, out of rotation until its first check passes
+)
+
+// A single upstream instance of an endpoint, with its own transport and circuit breaker
+type Upstream struct {
+	URL         *url.URL
+	Weight      int
+	Transport   *CbTransport
+	Proxy       *httputil.ReverseProxy
+	outstanding int64 // requests in flight
+	health      int32 // set by active health checks, upstreams without them are always healthy
+}
+
+// Whether the upstream can take traffic, an upstream which is unhealthy or whose breaker is open is ejected from rotation
+func (u *Upstream) Available() bool {
+	if !u.Healthy() {
+		return false
+	}
+	return u.Transport.BreakerState() != gobreaker.StateOpen
+}
+
+// Whether the upstream is passing its health checks, upstreams without health checks are always healthy
+func (u *Upstream) Healthy() bool {
+	return atomic.LoadInt32(&u.health) == upstreamHealthy
+}
+
+func (u *Upstream) healthState() int32 {
+	return atomic.LoadInt32(&u.health)
+}
+
+func (u *Upstream) setHealthy(healthy bool) {
+	if healthy {
+		atomic.StoreInt32(&u.health, upstreamHealthy)
+	} else {
+		atomic.StoreInt32(&u.health, upstreamUnhealthy)
+	}
+}
+
+// Number of requests in flight to the upstream
+func (u *Upstream) Outstanding() int64 {
+	return atomic.LoadInt64(&u.outstanding)
+}
+
+// Proxies the request to the upstream, tracking it as outstanding until it completes
+func (u *Upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&u.outstanding, 1)
+	defer atomic.AddInt64(&u.outstanding, -1)
+	u.Proxy.ServeHTTP(w, r)
+}
+
+// A Balancer picks the upstream for a request
+type Balancer interface {
+	Next(r *http.Request) *Upstream
+}
+
+// Instantiates the balancer for an endpoint's strategy
+func newBalancer(ep config.Endpoint, upstreams []*Upstream) Balancer {
+	switch ep.BalanceStrategy() {
+	case config.BalanceWeighted:
+		return newWeightedBalancer(upstreams)
+	case config.BalanceLeastRequests:
+		return &leastRequestsBalancer{upstreams}
+	case config.BalanceConsistentHash:
+		return newConsistentHashBalancer(upstreams, ep.LoadBalancer.HashHeader, ep.LoadBalancer.HashCookie)
+	default:
+		return &roundRobinBalancer{upstreams: upstreams}
+	}
+}
+
+// the upstreams which can take traffic, or all of them when none can so that requests still fail through a breaker
+func available(upstreams []*Upstream) []*Upstream {
+	avail := make([]*Upstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		if u.Available() {
+			avail = append(avail, u)
+		}
+	}
+	if len(avail) == 0 {
+		return upstreams
+	}
+	return avail
+}
+
+type roundRobinBalancer struct {
+	upstreams []*Upstream
+	next      uint32
+}
+
+func (b *roundRobinBalancer) Next(r *http.Request) *Upstream {
+	if len(b.upstreams) == 1 {
+		return b.upstreams[0]
+	}
+	avail := available(b.upstreams)
+	n := atomic.AddUint32(&b.next, 1)
+	return avail[int(n-1)%len(avail)]
+}
+
+// Smooth weighted round robin, which spreads the heavier upstreams' turns out rather than bunching them
+type weightedBalancer struct {
+	upstreams []*Upstream
+	current   map[*Upstream]int
+	lock      sync.Mutex
+}
+
+func newWeightedBalancer(upstreams []*Upstream) *weightedBalancer {
+	return &weightedBalancer{upstreams: upstreams, current: make(map[*Upstream]int)}
+}
+
+func (b *weightedBalancer) Next(r *http.Request) *Upstream {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var best *Upstream
+	total := 0
+	for _, u := range available(b.upstreams) {
+		b.current[u] += u.Weight
+		total += u.Weight
+		if nil == best || b.current[u] > b.current[best] {
+			best = u
+		}
+	}
+	b.current[best] -= total
+
+	return best
+}
+
+type leastRequestsBalancer struct {
+	upstreams []*Upstream
+}
+
+func (b *leastRequestsBalancer) Next(r *http.Request) *Upstream {
+	var best *Upstream
+	for _, u := range available(b.upstreams) {
+		if nil == best || u.Outstanding() < best.Outstanding() {
+			best = u
+		}
+	}
+	return best
+}
+
+// Hashes a header or cookie onto a ring of upstreams, so the same key keeps reaching the same upstream.
+// Requests without a key are balanced round robin.
+type consistentHashBalancer struct {
+	upstreams  []*Upstream
+	ring       []uint32
+	ringOwners map[uint32]*Upstream
+	hashHeader string
+	hashCookie string
+	fallback   *roundRobinBalancer
+}
+
+func newConsistentHashBalancer(upstreams []*Upstream, hashHeader string, hashCookie string) *consistentHashBalancer {
+	b := &consistentHashBalancer{
+		upstreams:  upstreams,
+		ringOwners: make(map[uint32]*Upstream),
+		hashHeader: hashHeader,
+		hashCookie: hashCookie,
+		fallback:   &roundRobinBalancer{upstreams: upstreams},
+	}
+
+	for _, u := range upstreams {
+		for i := 0; i < hashRingReplicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%v#%v", u.URL, i)))
+			b.ring = append(b.ring, h)
+			b.ringOwners[h] = u
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i] < b.ring[j] })
+
+	return b
+}
+
+// the hash key for the request, empty if it has none
+func (b *consistentHashBalancer) key(r *http.Request) string {
+	if b.hashHeader != "" {
+		if v := r.Header.Get(b.hashHeader); v != "" {
+			return v
+		}
+	}
+	if b.hashCookie != "" {
+		if c, err := r.Cookie(b.hashCookie); nil == err {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+func (b *consistentHashBalancer) Next(r *http.Request) *Upstream {
+	key := b.key(r)
+	if key == "" {
+		return b.fallback.Next(r)
+	}
+
+	// walk the ring from the key's position to the first available upstream
+	h := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i] >= h })
+	for i := 0; i < len(b.ring); i++ {
+		u := b.ringOwners[b.ring[(start+i)%len(b.ring)]]
+		if u.Available() {
+			return u
+		}
+	}
+
+	return b.ringOwners[b.ring[start%len(b.ring)]]
+}
@@ -0,0 +1,69 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/seansitter/gogw/auth"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Forwards claims of the authenticated principal to the endpoint as request headers
+type ClaimHeaders struct {
+	headers map[string]string // claim -> canonical header
+}
+
+// Instantiates ClaimHeaders, returns nil if the endpoint has no claim headers configured
+func newClaimHeaders(claimHeaders map[string]string) *ClaimHeaders {
+	if len(claimHeaders) == 0 {
+		return nil
+	}
+
+	headers := make(map[string]string)
+	for claim, header := range claimHeaders {
+		headers[claim] = http.CanonicalHeaderKey(header)
+	}
+	return &ClaimHeaders{headers}
+}
+
+// Removes any client supplied copies of the claim headers, so they cannot be spoofed
+func (ch *ClaimHeaders) Strip(r *http.Request) {
+	for _, header := range ch.headers {
+		r.Header.Del(header)
+	}
+}
+
+// Sets the claim headers from the claims, claims which are missing are left unset
+func (ch *ClaimHeaders) Inject(r *http.Request, claims auth.Claims) {
+	for claim, header := range ch.headers {
+		if v, ok := claims[claim]; ok && nil != v {
+			r.Header.Set(header, claimString(v))
+		}
+	}
+}
+
+// formats a claim as a header value, lists are space delimited as with oauth scopes
+func claimString(v interface{}) string {
+	switch cv := v.(type) {
+	case string:
+		return cv
+	case float64:
+		return strconv.FormatFloat(cv, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(cv)
+	case []interface{}:
+		vals := make([]string, len(cv))
+		for i, e := range cv {
+			vals[i] = claimString(e)
+		}
+		return strings.Join(vals, " ")
+	case []string:
+		return strings.Join(cv, " ")
+	default:
+		if b, err := json.Marshal(cv); nil == err {
+			return string(b)
+		}
+		return fmt.Sprintf("%v", cv)
+	}
+}
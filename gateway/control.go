@@ -0,0 +1,99 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sync/atomic"
+)
+
+// states an operator can put a route in
+const (
+	RouteActive   = "active"
+	RouteDraining = "draining" // the route still matches, but new requests get a 503 while those in flight finish
+	RouteDisabled = "disabled" // the route no longer matches, requests fall through to other routes or a 404
+)
+
+var routeStates = []string{RouteActive, RouteDraining, RouteDisabled}
+
+// Operator control of a route, set through the admin api. Controls are kept by endpoint name across reloads
+type routeControl struct {
+	inFlight int64        // atomic, requests dispatched to the route which have not finished
+	state    atomic.Value // string
+}
+
+func newRouteControl() *routeControl {
+	control := new(routeControl)
+	control.state.Store(RouteActive)
+	return control
+}
+
+func (control *routeControl) State() string {
+	if nil == control {
+		return RouteActive
+	}
+	return control.state.Load().(string)
+}
+
+func (control *routeControl) InFlight() int64 {
+	if nil == control {
+		return 0
+	}
+	return atomic.LoadInt64(&control.inFlight)
+}
+
+// tracks a request in flight to the route, until the returned func is called
+func (control *routeControl) begin() func() {
+	if nil == control {
+		return func() {}
+	}
+	atomic.AddInt64(&control.inFlight, 1)
+	return func() { atomic.AddInt64(&control.inFlight, -1) }
+}
+
+// Sets the state of the endpoint's route, which stays in that state across reloads until it is changed
+func (d *Dispatcher) SetRouteState(endpoint string, state string) error {
+	valid := false
+	for _, s := range routeStates {
+		valid = valid || s == state
+	}
+	if !valid {
+		return errors.New(fmt.Sprintf("unknown route state: '%v'", state))
+	}
+
+	route := d.findRoute(endpoint)
+	if nil == route {
+		return errors.New(fmt.Sprintf("no route for endpoint: %v", endpoint))
+	}
+
+	if from := route.control.State(); from != state {
+		route.control.state.Store(state)
+		log.Warnf("route for endpoint: %v changed from: %v to: %v", endpoint, from, state)
+	}
+	return nil
+}
+
+// the current route for the endpoint, nil when there is none
+func (d *Dispatcher) findRoute(endpoint string) *Route {
+	router := d.currentRouter()
+	if nil == router {
+		return nil
+	}
+
+	for _, route := range router.Routes() {
+		if route.Endpoint.Name == endpoint {
+			return &route
+		}
+	}
+	return nil
+}
+
+// The transport of the current routes with the name, nil when there is none
+func (d *Dispatcher) FindTransport(name string) *CbTransport {
+	for _, transport := range d.currentTransports() {
+		if transport.Name == name {
+			return transport
+		}
+	}
+	return nil
+}
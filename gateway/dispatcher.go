@@ -1,34 +1,34 @@
 package gateway
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/seansitter/gogw/auth"
 	"github.com/seansitter/gogw/config"
 	"github.com/seansitter/gogw/httperr"
 	gwlog "github.com/seansitter/gogw/log"
+	"github.com/seansitter/gogw/metrics"
 	log "github.com/sirupsen/logrus"
-	"github.com/sony/gobreaker"
-	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"runtime"
-	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // builder for the dispatcher, allows for proper construction
 type DispatcherBuilder struct {
 	endpoints  []config.Endpoint
+	metricsReg *metrics.Registry
 	dispatcher *Dispatcher
 }
 
 func NewDispatchBuilder() *DispatcherBuilder {
 	db := new(DispatcherBuilder)
 	db.dispatcher = new(Dispatcher)
+	db.dispatcher.authRegistry = auth.NewRegistry()
 	return db
 }
 
@@ -42,8 +42,33 @@ func (b *DispatcherBuilder) CircuitBreakerConfig(c *config.CircuitBreaker) *Disp
 	return b
 }
 
-func (b *DispatcherBuilder) AuthHandler(h auth.AuthHandler) *DispatcherBuilder {
-	b.dispatcher.authHandler = h
+// Sets the rate limit on each client across all endpoints, none when nil
+func (b *DispatcherBuilder) RateLimit(c *config.RateLimit) *DispatcherBuilder {
+	b.dispatcher.rateLimit = c
+	return b
+}
+
+// Sets the store of the rate limits' token buckets, ie one shared by the gateway's instances. Defaults to memory
+func (b *DispatcherBuilder) RateLimitStore(store RateLimitStore) *DispatcherBuilder {
+	b.dispatcher.rateLimitStore = store
+	return b
+}
+
+// Sets the registry of auth handlers, endpoints choose the schemes they accept by name (ie jwt, apikey)
+func (b *DispatcherBuilder) AuthRegistry(reg *auth.Registry) *DispatcherBuilder {
+	b.dispatcher.authRegistry = reg
+	return b
+}
+
+// Sets the access log requests are logged to, none when nil
+func (b *DispatcherBuilder) AccessLog(logger *gwlog.AccessLogger) *DispatcherBuilder {
+	b.dispatcher.accessLog = logger
+	return b
+}
+
+// Sets the registry the dispatcher's metrics are registered on, ie the one served on the admin port
+func (b *DispatcherBuilder) Metrics(reg *metrics.Registry) *DispatcherBuilder {
+	b.metricsReg = reg
 	return b
 }
 
@@ -52,10 +77,19 @@ func (b *DispatcherBuilder) Endpoints(e []config.Endpoint) *DispatcherBuilder {
 	return b
 }
 
-func (b *DispatcherBuilder) Build() *Dispatcher {
-	b.dispatcher.transports = make(map[string]http.RoundTripper)
-	b.dispatcher.configureRoutes(b.endpoints)
-	return b.dispatcher
+// Builds the dispatcher, failing when any of the endpoints' routes can't be configured
+func (b *DispatcherBuilder) Build() (*Dispatcher, error) {
+	b.dispatcher.transports = make(map[string]*CbTransport)
+	b.dispatcher.limiters = make(map[string]*ConcurrencyLimiter)
+	b.dispatcher.controls = make(map[string]*routeControl)
+	if nil == b.metricsReg {
+		b.metricsReg = metrics.NewRegistry()
+	}
+	if nil == b.dispatcher.rateLimitStore {
+		b.dispatcher.rateLimitStore = NewMemoryRateLimitStore()
+	}
+	b.dispatcher.metrics = newGatewayMetrics(b.metricsReg, b.dispatcher)
+	return b.dispatcher.configureRoutes(b.endpoints, b.dispatcher.proxyConfig, b.dispatcher.cbConfig, b.dispatcher.rateLimit)
 }
 
 // executes a single stage in the request pipeline
@@ -82,119 +116,134 @@ func (h *StageHandler) Execute(w http.ResponseWriter, r *http.Request) {
 type Route struct {
 	Endpoint     *config.Endpoint
 	StageHandler *StageHandler
+	Upstreams    []*Upstream
+	control      *routeControl
 }
 
 type Dispatcher struct {
-	routes      map[string]Route
-	authHandler auth.AuthHandler
-	proxyConfig config.Proxy
-	cbConfig    *config.CircuitBreaker
-	transports  map[string]http.RoundTripper
+	router         atomic.Value // *Router, swapped as a whole on reload
+	authRegistry   *auth.Registry
+	proxyConfig    config.Proxy
+	cbConfig       *config.CircuitBreaker
+	rateLimit      *config.RateLimit
+	rateLimitStore RateLimitStore // kept across reloads, a changed limit applies to the existing buckets
+	transports     map[string]*CbTransport
+	limiters       map[string]*ConcurrencyLimiter // by endpoint name
+	controls       map[string]*routeControl       // by endpoint name
+	metrics        *gatewayMetrics
+	accessLog      *gwlog.AccessLogger
+	checkers       []*HealthChecker
+	reloadLock     sync.Mutex
 }
 
-// A circuitbreaker is tied to a transport, which encapsulates the client/connection managment to and endpoint
-func newCircuitBreaker(name string, cbConfig *config.CircuitBreaker) *gobreaker.CircuitBreaker {
-	if nil == cbConfig {
-		return nil
-	}
-
-	cbSettings := gobreaker.Settings{
-		Interval:    cbConfig.ClearFailureCountIntervalMs * time.Millisecond,
-		MaxRequests: cbConfig.MaxHalfOpenRequests,
-		Name:        fmt.Sprintf("crctbrkr-%v", name),
-		Timeout:     cbConfig.HalfOpenAfterMs * time.Millisecond,
-		OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
-			log.Errorf("circuit breaker %v transitioned from: %v to: %v", name, from, to)
-		},
-	}
+// Creates a StageHandler which proxies the request to one of an endpoint's upstreams. Each upstream's transport
+// is taken from the set being built, or carried over from the live set when its settings are unchanged
+func (d *Dispatcher) newProxyStageHandler(ep config.Endpoint, rc routeConfig) (*StageHandler, error) {
+	// endpoint overrides are merged over the global settings, validation ensures they agree for shared transports
+	proxyConfig := ep.MergedProxy(rc.proxyConfig)
+	cbConfig := ep.MergedCircuitBreaker(rc.cbConfig)
 
-	return gobreaker.NewCircuitBreaker(cbSettings)
-}
+	epUpstreams := ep.Upstreams()
+	upstreams := make([]*Upstream, len(epUpstreams))
 
-// A transport is a connection-managing client
-func newTransport(proxyConfig config.Proxy) http.RoundTripper {
-	return &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   proxyConfig.DialTimeoutMs * time.Millisecond,
-			KeepAlive: proxyConfig.DialKeepAliveMs * time.Millisecond,
-			DualStack: true,
-		}).DialContext,
-		MaxIdleConns:          proxyConfig.MaxIdleConns,
-		IdleConnTimeout:       proxyConfig.IdleConnTimeoutMs * time.Millisecond,
-		TLSHandshakeTimeout:   proxyConfig.TLSHandshakeTimeoutMs * time.Millisecond,
-		ExpectContinueTimeout: proxyConfig.ExpectContinueTimeoutMs * time.Millisecond,
+	// the retry budget is shared by all of the endpoint's upstreams
+	var retryBudget *RetryBudget
+	if nil != ep.Retry {
+		retryBudget = newRetryBudget(*ep.Retry)
 	}
-}
 
-// This struct ties together a circuit breaker and transport. It implements the RoundTrip interface,
-// which is the core interface of a transport. This allows it to be used in the go native
-// reverse proxy without any other modifications.
-type CbTransport struct {
-	Transport      http.RoundTripper
-	CircuitBreaker *gobreaker.CircuitBreaker
-}
+	for i, epUpstream := range epUpstreams {
+		proxyUrl, err := url.Parse(epUpstream.URL)
+		if nil != err {
+			return nil, errors.New(fmt.Sprintf("failed to parse url: %v, for endpoint: %v, %v", epUpstream.URL, ep.Name, err))
+		}
 
-// Instantiates a CbTransport
-func newCbTransport(name string, proxyConfig config.Proxy, cbConfig *config.CircuitBreaker) http.RoundTripper {
-	return &CbTransport{
-		Transport:      newTransport(proxyConfig),
-		CircuitBreaker: newCircuitBreaker(name, cbConfig),
-	}
-}
+		// each upstream of a multi-url endpoint has its own transport, so one bad instance is ejected on its own
+		transName := ep.TransportName()
+		if len(epUpstreams) > 1 {
+			transName = fmt.Sprintf("%v-%v", transName, epUpstream.URL)
+		}
 
-// RoundTrip interface is implemented by CbTransport so that we can have a transport with a circuitbreaker
-func (transport *CbTransport) RoundTrip(request *http.Request) (*http.Response, error) {
-	var resp interface{}
-	var err error
-
-	if nil == transport.CircuitBreaker {
-		resp, err = transport.Transport.RoundTrip(request)
-	} else {
-		resp, err = transport.CircuitBreaker.Execute(func() (interface{}, error) {
-			r, e := transport.Transport.RoundTrip(request)
-			if nil != r && r.StatusCode >= 500 && r.StatusCode < 600 {
-				return nil, errors.New("500 error for service endpoint")
+		if _, ok := rc.transports[transName]; !ok {
+			if v, ok := d.transports[transName]; ok && v.configuredWith(proxyConfig, cbConfig) {
+				rc.transports[transName] = v
+			} else {
+				rc.transports[transName] = newCbTransport(transName, proxyConfig, cbConfig, d.metrics)
 			}
-			return r, e
-		})
-	}
-
-	if nil == resp {
-		return nil, err
-	}
+		}
 
-	return resp.(*http.Response), err
-}
+		// create the reverse proxy
+		routeProxy := httputil.NewSingleHostReverseProxy(proxyUrl)
+		routeProxy.Transport = rc.transports[transName]
+		routeProxy.ErrorHandler = proxyErrorHandler
+		routeProxy.ErrorLog = gwlog.LogAdapter() // the proxy's other errors, ie copying the body, aren't per request
+		if nil != ep.Retry {
+			routeProxy.Transport = newRetryTransport(rc.transports[transName], *ep.Retry, retryBudget)
+		}
 
-// Creates a StageHandler which proxies the request to an endpoint
-func (d *Dispatcher) newProxyStageHandler(ep config.Endpoint) (*StageHandler, error) {
-	proxyUrl, err := url.Parse(ep.URL)
-	if nil != err {
-		return nil, errors.New(fmt.Sprintf("failed to parse url: %v, for endpoint: %v, %v", ep.URL, ep.Name, err))
+		upstreams[i] = &Upstream{URL: proxyUrl, Weight: epUpstream.Weight, Transport: rc.transports[transName], Proxy: routeProxy}
+		if nil != ep.HealthCheck {
+			upstreams[i].health = d.upstreamHealth(ep.Name, proxyUrl.String())
+		}
 	}
 
-	transName := ep.Name
+	rc.upstreams[ep.Name] = upstreams
+	balancer := newBalancer(ep, upstreams)
 
-	if ep.SharedTransport != "" {
-		transName = ep.SharedTransport
-	}
+	requestTimeout := proxyConfig.RequestTimeoutMs * time.Millisecond
 
-	if v, ok := d.transports[transName]; ok {
-		d.transports[transName] = v
-	} else {
-		d.transports[transName] = newCbTransport(ep.Name, d.proxyConfig, d.cbConfig)
+	rewriter, err := newPathRewriter(ep)
+	if nil != err {
+		return nil, errors.New(fmt.Sprintf("failed to configure rewrite for endpoint: %v, %v", ep.Name, err))
 	}
 
-	// create the reverse proxy
-	routeProxy := httputil.NewSingleHostReverseProxy(proxyUrl)
-	routeProxy.Transport = d.transports[transName]
-	routeProxy.ErrorLog = gwlog.LogAdapter()
+	// the limiter is carried over from the live set when its settings are unchanged, keeping an adaptive limit
+	var limiter *ConcurrencyLimiter
+	if nil != ep.Concurrency {
+		if v, ok := d.limiters[ep.Name]; ok && v.configuredWith(*ep.Concurrency) {
+			limiter = v
+		} else {
+			limiter = newConcurrencyLimiter(ep.Name, *ep.Concurrency)
+		}
+		rc.limiters[ep.Name] = limiter
+	}
 
 	sh := &StageHandler{
 		Next: nil,
 		ExecHandler: func(w http.ResponseWriter, r *http.Request) bool {
-			routeProxy.ServeHTTP(w, r)
+			// shed the request when the endpoint is at its limit, rather than pile onto a slow upstream
+			if nil != limiter {
+				release, ok := limiter.Acquire(r.Context())
+				if !ok {
+					d.sendError(w, httperr.TooBusy)
+					return false
+				}
+
+				sw := &statusWriter{ResponseWriter: w}
+				start := time.Now()
+				defer func() {
+					release(sw.headerLatency(start), sw.status >= 500)
+				}()
+				w = sw
+			}
+
+			// bound the whole proxied request, including reading the response body
+			if requestTimeout > 0 {
+				ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+				defer cancel()
+				r = r.WithContext(ctx)
+			}
+			if nil != rewriter {
+				r = rewriter.Rewrite(r)
+			}
+
+			// the upstream's latency is until its response headers, not the time spent streaming the body
+			sw := &statusWriter{ResponseWriter: w}
+			upstreamStart := time.Now()
+			balancer.Next(r).ServeHTTP(sw, r)
+			if state := GetRequestState(r); nil != state {
+				state.UpstreamLatency = sw.headerLatency(upstreamStart)
+			}
 			return false
 		},
 	}
@@ -202,21 +251,52 @@ func (d *Dispatcher) newProxyStageHandler(ep config.Endpoint) (*StageHandler, er
 	return sh, nil
 }
 
-// Creates a StageHandler chain which authenticates before proxying
-func (d *Dispatcher) newAuthenticatingProxyStageHandler(ep config.Endpoint) (*StageHandler, error) {
-	if nil == d.authHandler {
-		return nil, errors.New("authenticated service configured but no auth handler set")
+// Creates a StageHandler chain which authenticates, and optionally authorizes, before proxying
+func (d *Dispatcher) newAuthenticatingProxyStageHandler(ep config.Endpoint, rc routeConfig) (*StageHandler, error) {
+	authHandler, err := d.authRegistry.Chain(ep.AuthSchemes())
+	if nil != err {
+		return nil, errors.New(fmt.Sprintf("failed to configure auth for endpoint: %v, %v", ep.Name, err))
 	}
 
-	proxySh, err := d.newProxyStageHandler(ep)
+	proxySh, err := d.newProxyStageHandler(ep, rc)
 	if nil != err {
 		return nil, err
 	}
 
+	claimHeaders := newClaimHeaders(ep.ClaimHeaders)
+
+	// authorization, when configured, sits between authentication and the proxy
+	next := proxySh
+	if len(ep.Authorize) > 0 {
+		next = d.newAuthzStageHandler(ep, proxySh)
+	}
+
+	// limits keyed by the principal apply once the client is authenticated, so that it can be told apart
+	next = d.newRateLimitStageHandler(ep, rc, rateLimitAfterAuth, next)
+
 	sh := &StageHandler{
-		Next: proxySh,
+		Next: next,
 		ExecHandler: func(w http.ResponseWriter, r *http.Request) bool {
-			if ok, httpErr := d.authHandler(r); !ok {
+			if nil != claimHeaders {
+				claimHeaders.Strip(r)
+			}
+
+			result, httpErr := authHandler(r)
+
+			// the principal may be restricted to some endpoints, ie by its api key
+			if nil != result && result.Success {
+				if restricted, ok := result.Artifact.(auth.EndpointRestricted); ok && !restricted.AllowsEndpoint(ep.Name) {
+					result, httpErr = nil, &httperr.Forbidden
+				}
+			}
+
+			if nil == result || !result.Success {
+				status := http.StatusForbidden
+				if nil != httpErr {
+					status = httpErr.Code
+				}
+				d.metrics.auth.Inc(ep.Name, authResult(status))
+
 				if nil != httpErr {
 					if httpErr.Code != 0 {
 						w.WriteHeader(httpErr.Code)
@@ -231,44 +311,154 @@ func (d *Dispatcher) newAuthenticatingProxyStageHandler(ep config.Endpoint) (*St
 
 				return false
 			}
+
+			d.metrics.auth.Inc(ep.Name, authResult(0))
+			if state := GetRequestState(r); nil != state {
+				state.Claims = result.Claims
+			}
+			if nil != claimHeaders {
+				claimHeaders.Inject(r, result.Claims)
+			}
 			return true
 		},
 	}
 
-	return sh, nil
+	// the other limits apply before authentication, so that floods of bad or missing credentials are shed
+	// without taking up the auth workers
+	return d.newRateLimitStageHandler(ep, rc, rateLimitBeforeAuth, sh), nil
 }
 
-func (d *Dispatcher) configureRoutes(endpoints []config.Endpoint) (*Dispatcher, error) {
+// The settings a route table is built from, along with the transports created for it
+type routeConfig struct {
+	proxyConfig config.Proxy
+	cbConfig    *config.CircuitBreaker
+	rateLimit   *config.RateLimit
+	transports  map[string]*CbTransport
+	upstreams   map[string][]*Upstream         // by endpoint name
+	limiters    map[string]*ConcurrencyLimiter // by endpoint name
+	controls    map[string]*routeControl       // by endpoint name
+}
+
+// Builds a new route table and swaps it in. Nothing is replaced unless every route builds, so a
+// bad config leaves the live routes untouched.
+func (d *Dispatcher) configureRoutes(endpoints []config.Endpoint, proxyConfig config.Proxy, cbConfig *config.CircuitBreaker, rateLimit *config.RateLimit) (*Dispatcher, error) {
+	rc := routeConfig{proxyConfig, cbConfig, rateLimit, make(map[string]*CbTransport), make(map[string][]*Upstream), make(map[string]*ConcurrencyLimiter), make(map[string]*routeControl)}
+
 	// build routes
-	routes := make(map[string]Route)
+	routes := make([]Route, 0, len(endpoints))
 
 	for _, ep := range endpoints {
 		var sh *StageHandler
 		var err error
-		if ep.Authenticate {
-			sh, err = d.newAuthenticatingProxyStageHandler(ep)
+		if ep.Authenticated() {
+			sh, err = d.newAuthenticatingProxyStageHandler(ep, rc)
 		} else {
-			sh, err = d.newProxyStageHandler(ep)
+			sh, err = d.newProxyStageHandler(ep, rc)
+			if nil == err {
+				sh = d.newRateLimitStageHandler(ep, rc, rateLimitUnauthenticated, sh)
+			}
 		}
 
 		if nil != err {
 			return nil, err
 		}
 
-		routes[ep.Name] = Route{Endpoint: ep.Copy(), StageHandler: sh}
+		// a route drained or disabled by an operator stays that way across the reload
+		control, ok := d.controls[ep.Name]
+		if !ok {
+			control = newRouteControl()
+		}
+		rc.controls[ep.Name] = control
+
+		routes = append(routes, Route{Endpoint: ep.Copy(), StageHandler: sh, Upstreams: rc.upstreams[ep.Name], control: control})
 	}
 
-	d.routes = routes
+	d.proxyConfig = proxyConfig
+	d.cbConfig = cbConfig
+	d.rateLimit = rateLimit
+	d.transports = rc.transports
+	d.limiters = rc.limiters
+	d.controls = rc.controls
+	d.router.Store(newRouter(routes))
+
+	// the old routes' health checkers are replaced by checkers for the new upstreams
+	d.stopHealthChecks()
+	d.startHealthChecks(routes)
 
 	return d, nil
 }
 
+// The health of the live route's upstream with the url, so that an unchanged upstream keeps its health
+// across a reload. Unchecked when there is no such upstream, which keeps it out of rotation until it passes
+func (d *Dispatcher) upstreamHealth(endpoint string, upstreamURL string) int32 {
+	if route := d.findRoute(endpoint); nil != route && nil != route.Endpoint.HealthCheck {
+		for _, upstream := range route.Upstreams {
+			if upstream.URL.String() == upstreamURL {
+				return upstream.healthState()
+			}
+		}
+	}
+	return upstreamUnchecked
+}
+
+// starts active health checks for the upstreams of each route configured with them
+func (d *Dispatcher) startHealthChecks(routes []Route) {
+	for _, route := range routes {
+		if nil == route.Endpoint.HealthCheck {
+			continue
+		}
+		for _, upstream := range route.Upstreams {
+			checker := newHealthChecker(route.Endpoint.Name, upstream, *route.Endpoint.HealthCheck)
+			checker.Start()
+			d.checkers = append(d.checkers, checker)
+		}
+	}
+}
+
+func (d *Dispatcher) stopHealthChecks() {
+	for _, checker := range d.checkers {
+		checker.Stop()
+	}
+	d.checkers = nil
+}
+
+// Stops the dispatcher's background work, ie health checks
+func (d *Dispatcher) Stop() {
+	d.reloadLock.Lock()
+	defer d.reloadLock.Unlock()
+
+	d.stopHealthChecks()
+}
+
+// Reloads the routes from a new config. Transports whose settings are unchanged are kept, along with their
+// circuit breaker state. Requests already dispatched finish on the routes they started with.
+func (d *Dispatcher) Reload(c *config.Config) error {
+	d.reloadLock.Lock()
+	defer d.reloadLock.Unlock()
+
+	_, err := d.configureRoutes(c.Endpoints, c.Proxy, c.CircuitBreaker, c.RateLimit)
+	return err
+}
+
+// the current route table
+func (d *Dispatcher) currentRouter() *Router {
+	router, _ := d.router.Load().(*Router)
+	return router
+}
+
 // Sends an error response, used when an immediate error response is called for (ie 404)
 func (dispatcher *Dispatcher) sendError(w http.ResponseWriter, e httperr.Error) {
 	w.WriteHeader(e.Code)
 	fmt.Fprintf(w, "%v: %v", e.Message, e.Code)
 }
 
+// The reverse proxies' error handler, which logs the error with the request's logger and answers with a 502
+// as the default handler does
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	gwlog.FromContext(r.Context()).Errorf("http: proxy error: %v", err)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
 // Dispatcher implements the ServeHTTP interface so that it can be used directly as a
 // handler for the golang http server
 func (dispatcher *Dispatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -276,34 +466,54 @@ func (dispatcher *Dispatcher) ServeHTTP(w http.ResponseWriter, r *http.Request)
 }
 
 func (dispatcher *Dispatcher) Dispatch(w http.ResponseWriter, r *http.Request) error {
-	pathSgmts := strings.Split(r.URL.Path, "/")
-	if len(pathSgmts) >= 1 {
-		if matchRoute, ok := dispatcher.routes[pathSgmts[1]]; ok {
-			sh := matchRoute.StageHandler
-			for nil != sh {
-				if !sh.ExecHandler(w, r) {
-					break
-				}
-				sh = matchRoute.StageHandler.Next
-			}
-		} else {
-			dispatcher.sendError(w, httperr.NotFound)
-		}
-	} else {
+	start := time.Now()
+	var matchRoute *Route
+	var params map[string]string
+	if router := dispatcher.currentRouter(); nil != router {
+		matchRoute, params = router.Match(r)
+	}
+
+	metricsEndpoint := unmatchedEndpoint
+	if nil != matchRoute {
+		metricsEndpoint = matchRoute.Endpoint.Name
+	}
+
+	// the request's id is forwarded upstream, returned to the client and carried by every line logged for it
+	requestID := requestID(r)
+	r.Header.Set(RequestIDHeader, requestID)
+	r = r.WithContext(gwlog.WithLogger(r.Context(), log.WithField(gwlog.RequestIDField, requestID)))
+
+	// every request is measured and logged once it has been handled, including those which matched no route
+	sw := &statusWriter{ResponseWriter: w, requestID: requestID}
+	state := &RequestState{RequestID: requestID}
+	done := dispatcher.metrics.trackRequest(sw, r, metricsEndpoint)
+	if nil != dispatcher.accessLog {
+		entry := newAccessEntry(r, start)
+		defer func() { dispatcher.logAccess(entry, sw, state) }()
+	}
+	defer done()
+	w = sw
+
+	if nil == matchRoute {
 		dispatcher.sendError(w, httperr.NotFound)
+		return nil
 	}
 
-	return nil
-}
+	state.Endpoint = matchRoute.Endpoint.Name
+	if matchRoute.control.State() == RouteDraining {
+		dispatcher.sendError(w, httperr.Unavailable)
+		return nil
+	}
+	defer matchRoute.control.begin()()
 
-/**
-Gets the go function id
-**/
-func getGID() uint64 {
-	b := make([]byte, 64)
-	b = b[:runtime.Stack(b, false)]
-	b = bytes.TrimPrefix(b, []byte("goroutine "))
-	b = b[:bytes.IndexByte(b, ' ')]
-	n, _ := strconv.ParseUint(string(b), 10, 64)
-	return n
+	r = withRequestState(withPathParams(r, params), state)
+	sh := matchRoute.StageHandler
+	for nil != sh {
+		if !sh.ExecHandler(w, r) {
+			break
+		}
+		sh = sh.Next
+	}
+
+	return nil
 }
@@ -0,0 +1,117 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/seansitter/gogw/config"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Actively checks the health of an upstream, taking it out of rotation after enough consecutive failures
+// and back in after enough consecutive passes
+type HealthChecker struct {
+	endpoint string
+	upstream *Upstream
+	config   config.HealthCheck
+	client   *http.Client
+	passes   int
+	failures int
+	quitChan chan bool
+}
+
+// Instantiates a HealthChecker. The checks go through the upstream's transport, but not its
+// circuit breaker, so they do not count against it
+func newHealthChecker(endpoint string, upstream *Upstream, hcConfig config.HealthCheck) *HealthChecker {
+	return &HealthChecker{
+		endpoint: endpoint,
+		upstream: upstream,
+		config:   hcConfig,
+		client: &http.Client{
+			Transport: upstream.Transport.Transport,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse // the status of the check url itself is what counts
+			},
+		},
+		quitChan: make(chan bool),
+	}
+}
+
+// Starts the check loop
+func (hc *HealthChecker) Start() {
+	go func() {
+		ticker := time.NewTicker(hc.config.IntervalMs * time.Millisecond)
+		defer ticker.Stop()
+
+		hc.check()
+		for {
+			select {
+			case <-ticker.C:
+				hc.check()
+			case <-hc.quitChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stops the check loop
+func (hc *HealthChecker) Stop() {
+	close(hc.quitChan)
+}
+
+// runs a single check and updates the upstream's health when a threshold is crossed
+func (hc *HealthChecker) check() {
+	err := hc.probe()
+	state := hc.upstream.healthState()
+	if nil == err {
+		hc.passes++
+		hc.failures = 0
+		// a new upstream joins the rotation as soon as it passes, one which failed must pass enough checks
+		if state == upstreamUnchecked || (state == upstreamUnhealthy && hc.passes >= hc.config.HealthyThreshold) {
+			hc.upstream.setHealthy(true)
+			log.Infof("upstream: %v for endpoint: %v is healthy", hc.upstream.URL, hc.endpoint)
+		}
+		return
+	}
+
+	hc.failures++
+	hc.passes = 0
+	log.Debugf("health check failed for upstream: %v, endpoint: %v, %v", hc.upstream.URL, hc.endpoint, err)
+	if state == upstreamUnchecked {
+		hc.upstream.setHealthy(false)
+		log.Errorf("upstream: %v for endpoint: %v failed its first health check, kept out of rotation: %v", hc.upstream.URL, hc.endpoint, err)
+		return
+	}
+	if state == upstreamHealthy && hc.failures >= hc.config.UnhealthyThreshold {
+		hc.upstream.setHealthy(false)
+		log.Errorf("upstream: %v for endpoint: %v is unhealthy, removed from rotation: %v", hc.upstream.URL, hc.endpoint, err)
+	}
+}
+
+// makes the health check request
+func (hc *HealthChecker) probe() error {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.config.TimeoutMs*time.Millisecond)
+	defer cancel()
+
+	checkUrl := strings.TrimSuffix(hc.upstream.URL.String(), "/") + hc.config.Path
+	req, err := http.NewRequest("GET", checkUrl, nil)
+	if nil != err {
+		return err
+	}
+
+	resp, err := hc.client.Do(req.WithContext(ctx))
+	if nil != err {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != hc.config.ExpectedStatus {
+		return errors.New(fmt.Sprintf("unexpected status: %v, expected: %v", resp.StatusCode, hc.config.ExpectedStatus))
+	}
+
+	return nil
+}
@@ -0,0 +1,267 @@
+package gateway
+
+import (
+	"context"
+	"github.com/seansitter/gogw/config"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Limits the requests in flight to an endpoint, so that a slow upstream can't pin all of the gateway's
+// goroutines and connections. Requests beyond the limit wait in a bounded queue, or are shed. In adaptive
+// mode the limit is tuned from the upstream's latency.
+type ConcurrencyLimiter struct {
+	name         string
+	config       config.Concurrency
+	limit        float64 // fractional, so that small adjustments accumulate
+	inFlight     int
+	waiters      []chan bool // fifo, a waiter is signalled when it is let in
+	queueTimeout time.Duration
+	adjust       func(limit float64, sample limitSample) float64 // nil for a static limit
+	lock         sync.Mutex
+}
+
+// the outcome of a request, fed to an adaptive limit
+type limitSample struct {
+	latency  time.Duration
+	dropped  bool // the upstream failed or was too slow
+	inFlight int  // requests in flight when the request started
+}
+
+func newConcurrencyLimiter(name string, c config.Concurrency) *ConcurrencyLimiter {
+	limiter := &ConcurrencyLimiter{
+		name:         name,
+		config:       c,
+		limit:        float64(c.Max),
+		queueTimeout: c.QueueTimeoutMs * time.Millisecond,
+	}
+
+	if nil != c.Adaptive {
+		// the initial limit starts within the adaptive bounds
+		limiter.limit = clampLimit(limiter.limit, *c.Adaptive)
+		switch c.Adaptive.Algorithm {
+		case config.LimitGradient:
+			limiter.adjust = newGradientLimit(*c.Adaptive)
+		default:
+			limiter.adjust = newAIMDLimit(*c.Adaptive)
+		}
+	}
+
+	return limiter
+}
+
+// whether the limiter was created from the settings, so that it can be kept across a reload
+func (limiter *ConcurrencyLimiter) configuredWith(c config.Concurrency) bool {
+	return reflect.DeepEqual(limiter.config, c)
+}
+
+// The current limit
+func (limiter *ConcurrencyLimiter) Limit() int {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	return limiter.currentLimit()
+}
+
+func (limiter *ConcurrencyLimiter) currentLimit() int {
+	return int(limiter.limit)
+}
+
+// Takes a place for a request, waiting in the queue when the limit is reached. Returns false when the request
+// should be shed, ie the queue is full or the wait timed out. On success the returned func must be called with
+// the outcome of the request
+func (limiter *ConcurrencyLimiter) Acquire(ctx context.Context) (func(latency time.Duration, dropped bool), bool) {
+	limiter.lock.Lock()
+	if limiter.inFlight < limiter.currentLimit() {
+		limiter.inFlight++
+		inFlight := limiter.inFlight
+		limiter.lock.Unlock()
+		return limiter.releaser(inFlight), true
+	}
+
+	if len(limiter.waiters) >= limiter.config.QueueDepth {
+		limiter.lock.Unlock()
+		return nil, false
+	}
+
+	waiter := make(chan bool, 1)
+	limiter.waiters = append(limiter.waiters, waiter)
+	limiter.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if limiter.queueTimeout > 0 {
+		timer := time.NewTimer(limiter.queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-waiter:
+		return limiter.releaser(limiter.inFlightNow()), true
+	case <-timeout:
+	case <-ctx.Done():
+	}
+
+	// the waiter may have been let in while giving up, in which case its place is handed on
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	if !limiter.removeWaiter(waiter) {
+		limiter.inFlight--
+		limiter.admit()
+	}
+	return nil, false
+}
+
+func (limiter *ConcurrencyLimiter) inFlightNow() int {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	return limiter.inFlight
+}
+
+// removes a waiter from the queue, returning false when it was already let in
+func (limiter *ConcurrencyLimiter) removeWaiter(waiter chan bool) bool {
+	for i, w := range limiter.waiters {
+		if w == waiter {
+			limiter.waiters = append(limiter.waiters[:i], limiter.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// lets waiters in while there is room under the limit
+func (limiter *ConcurrencyLimiter) admit() {
+	for len(limiter.waiters) > 0 && limiter.inFlight < limiter.currentLimit() {
+		waiter := limiter.waiters[0]
+		limiter.waiters = limiter.waiters[1:]
+		limiter.inFlight++
+		waiter <- true
+	}
+}
+
+// returns the func which frees a request's place, and adjusts an adaptive limit from its outcome
+func (limiter *ConcurrencyLimiter) releaser(inFlight int) func(latency time.Duration, dropped bool) {
+	var once sync.Once
+	return func(latency time.Duration, dropped bool) {
+		once.Do(func() {
+			limiter.lock.Lock()
+			defer limiter.lock.Unlock()
+
+			limiter.inFlight--
+			if nil != limiter.adjust {
+				prev := limiter.currentLimit()
+				limiter.limit = limiter.adjust(limiter.limit, limitSample{latency, dropped, inFlight})
+				if limit := limiter.currentLimit(); limit != prev {
+					log.Debugf("concurrency limit for endpoint: %v changed from: %v to: %v", limiter.name, prev, limit)
+				}
+			}
+			limiter.admit()
+		})
+	}
+}
+
+// Additive increase, multiplicative decrease. The limit grows by one for each request which succeeded while
+// the limit was in use, and backs off by a ratio for each request which failed or exceeded the latency threshold
+func newAIMDLimit(c config.AdaptiveLimit) func(limit float64, sample limitSample) float64 {
+	threshold := c.LatencyThresholdMs * time.Millisecond
+	return func(limit float64, sample limitSample) float64 {
+		if sample.dropped || sample.latency > threshold {
+			limit = limit * c.BackoffRatio
+		} else if float64(sample.inFlight)*2 >= limit {
+			// only grow when the limit is being used, so that an idle endpoint doesn't grow without bound
+			limit = limit + 1
+		}
+		return clampLimit(limit, c)
+	}
+}
+
+// Gradient, after netflix's concurrency-limits. The limit follows the ratio of the long term average latency
+// to the latest latency, so it shrinks as the upstream queues requests and latency rises, with headroom of
+// sqrt(limit) for growth
+func newGradientLimit(c config.AdaptiveLimit) func(limit float64, sample limitSample) float64 {
+	var longLatency float64 // exponentially weighted average, in ns
+	return func(limit float64, sample limitSample) float64 {
+		latency := float64(sample.latency)
+		if sample.dropped {
+			return clampLimit(limit*c.BackoffRatio, c)
+		}
+		if latency <= 0 {
+			return limit
+		}
+
+		if longLatency == 0 {
+			longLatency = latency
+		} else {
+			longLatency = longLatency*0.95 + latency*0.05
+		}
+
+		// an idle endpoint gives no signal about the limit it could take
+		if float64(sample.inFlight)*2 < limit {
+			return limit
+		}
+
+		gradient := math.Max(0.5, math.Min(1.0, longLatency/latency))
+		newLimit := limit*gradient + math.Sqrt(limit)
+		return clampLimit(limit*(1-c.Smoothing)+newLimit*c.Smoothing, c)
+	}
+}
+
+func clampLimit(limit float64, c config.AdaptiveLimit) float64 {
+	return math.Max(float64(c.MinLimit), math.Min(float64(c.MaxLimit), limit))
+}
+
+// Records the status, the time the response headers were written, ie the upstream's latency for a proxied
+// request, and the bytes of the body. The request id, when set, is returned in the response headers
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader time.Time
+	bytes       int64
+	requestID   string
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.wroteHeader = time.Now()
+		if w.requestID != "" {
+			w.Header().Set(RequestIDHeader, w.requestID) // replaces any the upstream echoed back
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// the time from start until the response headers were written, or until now when they haven't been
+func (w *statusWriter) headerLatency(start time.Time) time.Duration {
+	if w.wroteHeader.IsZero() {
+		return time.Since(start)
+	}
+	return w.wroteHeader.Sub(start)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// streaming responses are flushed through to the client. A flush before the headers are written sends them,
+// so they are written here first to carry the request id
+func (w *statusWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,40 @@
+package gateway
+
+import (
+	"github.com/seansitter/gogw/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdaptiveLimitStartsWithinBounds(t *testing.T) {
+	limiter := newConcurrencyLimiter("test", config.Concurrency{
+		Max:      50,
+		Adaptive: &config.AdaptiveLimit{MinLimit: 1, MaxLimit: 20},
+	})
+	if limit := limiter.Limit(); limit != 20 {
+		t.Errorf("expected the initial limit to be clamped to maxLimit: 20, got: %v", limit)
+	}
+
+	static := newConcurrencyLimiter("test", config.Concurrency{Max: 50})
+	if limit := static.Limit(); limit != 50 {
+		t.Errorf("expected a static limit of 50, got: %v", limit)
+	}
+}
+
+func TestStatusWriterFlushCarriesRequestID(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &statusWriter{ResponseWriter: rec, requestID: "req-1"}
+	w.Header().Set(RequestIDHeader, "echoed-by-upstream")
+
+	// a streamed response flushed before anything is written
+	w.Flush()
+	w.Write([]byte("chunk"))
+
+	if id := rec.Header().Get(RequestIDHeader); id != "req-1" {
+		t.Errorf("expected the request id header: req-1, got: %v", id)
+	}
+	if w.status != http.StatusOK || !rec.Flushed {
+		t.Errorf("expected a flushed 200, got: %v, flushed: %v", w.status, rec.Flushed)
+	}
+}
@@ -0,0 +1,199 @@
+package gateway
+
+import (
+	"context"
+	"github.com/seansitter/gogw/metrics"
+	"github.com/sony/gobreaker"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the endpoint label of requests which matched no route
+const unmatchedEndpoint = "unmatched"
+
+// The gateway's metrics, served on the admin port
+type gatewayMetrics struct {
+	requests           *metrics.Counter   // endpoint, method, status_class
+	requestDuration    *metrics.Histogram // endpoint, method, status_class
+	inFlight           *metrics.Gauge     // endpoint, method
+	auth               *metrics.Counter   // endpoint, result
+	rateLimited        *metrics.Counter   // endpoint, scope
+	breakerTransitions *metrics.Counter   // transport, from, to
+	breakerRejections  *metrics.Counter   // transport
+	connsOpened        *metrics.Counter   // transport
+	connsOpen          *metrics.Gauge     // transport
+	dialErrors         *metrics.Counter   // transport
+}
+
+// Registers the gateway's metrics. The circuit breaker states are read from the dispatcher's current routes
+// when the metrics are written
+func newGatewayMetrics(reg *metrics.Registry, d *Dispatcher) *gatewayMetrics {
+	m := &gatewayMetrics{
+		requests: reg.NewCounter("gogw_requests_total",
+			"Requests handled, by endpoint, method and status class.", "endpoint", "method", "status_class"),
+		requestDuration: reg.NewHistogram("gogw_request_duration_seconds",
+			"Time to handle a request, including auth and the upstream.", metrics.DefaultBuckets, "endpoint", "method", "status_class"),
+		inFlight: reg.NewGauge("gogw_requests_in_flight",
+			"Requests being handled.", "endpoint", "method"),
+		auth: reg.NewCounter("gogw_auth_total",
+			"Authentications, by endpoint and result: success, failure, forbidden or error.", "endpoint", "result"),
+		rateLimited: reg.NewCounter("gogw_rate_limited_total",
+			"Requests refused for being over a rate limit, by endpoint and the scope of the limit: endpoint or global.", "endpoint", "scope"),
+		breakerTransitions: reg.NewCounter("gogw_circuit_breaker_transitions_total",
+			"Circuit breaker state changes.", "transport", "from", "to"),
+		breakerRejections: reg.NewCounter("gogw_circuit_breaker_rejections_total",
+			"Calls not sent because the circuit breaker was open, or had let through its half-open requests.", "transport"),
+		connsOpened: reg.NewCounter("gogw_upstream_connections_opened_total",
+			"Connections opened to upstreams.", "transport"),
+		connsOpen: reg.NewGauge("gogw_upstream_connections_open",
+			"Connections open to upstreams, idle or in use.", "transport"),
+		dialErrors: reg.NewCounter("gogw_upstream_dial_errors_total",
+			"Failed connection attempts to upstreams.", "transport"),
+	}
+
+	reg.NewGaugeFunc("gogw_circuit_breaker_state",
+		"Circuit breaker state: 0 closed, 1 half-open, 2 open.", []string{"transport"},
+		func(emit func(float64, ...string)) {
+			for _, transport := range d.currentTransports() {
+				if nil != transport.CircuitBreaker() || transport.ForcedOpen() {
+					emit(float64(transport.BreakerState()), transport.Name)
+				}
+			}
+		})
+
+	// the breakers' own counts, which are those of the current generation: since the breaker last changed state,
+	// or cleared its counts at the end of an interval while closed
+	breakerCounts := []struct {
+		name  string
+		help  string
+		count func(BreakerCounts) uint32
+	}{
+		{"gogw_circuit_breaker_requests", "Requests through the circuit breaker in its current generation.",
+			func(c BreakerCounts) uint32 { return c.Requests }},
+		{"gogw_circuit_breaker_successes", "Successful requests in the circuit breaker's current generation.",
+			func(c BreakerCounts) uint32 { return c.Successes }},
+		{"gogw_circuit_breaker_failures", "Failed requests in the circuit breaker's current generation.",
+			func(c BreakerCounts) uint32 { return c.Failures }},
+		{"gogw_circuit_breaker_consecutive_failures", "Consecutive failed requests through the circuit breaker.",
+			func(c BreakerCounts) uint32 { return c.ConsecutiveFailures }},
+	}
+	for _, bc := range breakerCounts {
+		count := bc.count
+		reg.NewGaugeFunc(bc.name, bc.help, []string{"transport"}, func(emit func(float64, ...string)) {
+			for _, transport := range d.currentTransports() {
+				if nil != transport.CircuitBreaker() {
+					emit(float64(count(transport.Counts())), transport.Name)
+				}
+			}
+		})
+	}
+
+	return m
+}
+
+// the method label of a request, other methods are grouped so that clients can't grow the label set
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+// the status class label of a response, ie 2xx. nothing written is a 200
+func statusClass(status int) string {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// Records a request handled with the writer, returning the func to call once it is done
+func (m *gatewayMetrics) trackRequest(sw *statusWriter, r *http.Request, endpoint string) func() {
+	method := methodLabel(r.Method)
+	m.inFlight.Inc(endpoint, method)
+	start := time.Now()
+
+	return func() {
+		class := statusClass(sw.status)
+		m.inFlight.Dec(endpoint, method)
+		m.requests.Inc(endpoint, method, class)
+		m.requestDuration.Observe(time.Since(start).Seconds(), endpoint, method, class)
+	}
+}
+
+// the result label of an authentication, from the status the auth stage responded with
+func authResult(status int) string {
+	switch {
+	case status == 0:
+		return "success"
+	case status == http.StatusForbidden:
+		return "forbidden"
+	case status == http.StatusUnauthorized:
+		return "failure"
+	}
+	return "error" // ie the auth workers are busy
+}
+
+// Records a call the circuit breaker rejected, the breaker doesn't count those
+func (m *gatewayMetrics) breakerRejected(transport string) {
+	m.breakerRejections.Inc(transport)
+}
+
+func (m *gatewayMetrics) breakerStateChange(transport string, from gobreaker.State, to gobreaker.State) {
+	m.breakerTransitions.Inc(transport, from.String(), to.String())
+}
+
+// Wraps a dialer so that the connections it opens for the transport are counted
+func (m *gatewayMetrics) countingDialer(transport string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if nil != err {
+			m.dialErrors.Inc(transport)
+			return nil, err
+		}
+
+		m.connsOpened.Inc(transport)
+		m.connsOpen.Inc(transport)
+		return &countedConn{Conn: conn, onClose: func() { m.connsOpen.Dec(transport) }}, nil
+	}
+}
+
+// A connection which reports when it is closed, once
+type countedConn struct {
+	net.Conn
+	onClose   func()
+	closeOnce sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.closeOnce.Do(c.onClose)
+	return c.Conn.Close()
+}
+
+// the transports of the current routes, once each, by name
+func (d *Dispatcher) currentTransports() []*CbTransport {
+	router := d.currentRouter()
+	if nil == router {
+		return nil
+	}
+
+	var transports []*CbTransport
+	seen := make(map[*CbTransport]bool)
+	for _, route := range router.Routes() {
+		for _, upstream := range route.Upstreams {
+			if nil != upstream.Transport && !seen[upstream.Transport] {
+				seen[upstream.Transport] = true
+				transports = append(transports, upstream.Transport)
+			}
+		}
+	}
+
+	sort.Slice(transports, func(i, j int) bool { return transports[i].Name < transports[j].Name })
+	return transports
+}
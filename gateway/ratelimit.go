@@ -0,0 +1,248 @@
+package gateway
+
+import (
+	"github.com/seansitter/gogw/config"
+	"github.com/seansitter/gogw/httperr"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// how often the memory store drops the buckets which have refilled, which are the same as no bucket
+const rateLimitSweepInterval = 10 * time.Second
+
+// A request for a token from the bucket of a key, which refills at Rate tokens a second up to Burst
+type RateLimitRequest struct {
+	Key   string
+	Rate  float64
+	Burst int
+}
+
+// The state of a client's token bucket, after a request took a token from it or was refused one
+type RateLimitResult struct {
+	Allowed    bool          // the bucket had a token, it is only taken when every bucket of the request had one
+	Limit      int           // the bucket's size, its burst
+	Remaining  int           // whole tokens left in the bucket
+	Reset      time.Duration // until the bucket is full again
+	RetryAfter time.Duration // until a token is available, when the request was refused
+}
+
+// Holds the token buckets of the rate limits, by key. The gateway keeps them in memory, a store shared by
+// the gateway's instances (ie redis) could implement this so that they enforce one limit between them
+type RateLimitStore interface {
+	// takes a token from the bucket of each of the requests, only when every one of them has a token. So a
+	// request refused by one limit doesn't use up the client's quota of the others. A result for each request
+	Take(requests ...RateLimitRequest) []RateLimitResult
+}
+
+// A RateLimitStore which keeps the buckets in memory, the limits are per gateway instance
+type MemoryRateLimitStore struct {
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // when the tokens were last refilled
+	rate   float64
+	burst  int
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+}
+
+func (store *MemoryRateLimitStore) Take(requests ...RateLimitRequest) []RateLimitResult {
+	return store.take(time.Now(), requests...)
+}
+
+func (store *MemoryRateLimitStore) take(now time.Time, requests ...RateLimitRequest) []RateLimitResult {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if now.Sub(store.lastSweep) >= rateLimitSweepInterval {
+		store.sweep(now)
+	}
+
+	// a new bucket starts full. the rate and burst are those of the latest request, so a reload applies at once
+	buckets := make([]*tokenBucket, len(requests))
+	allowed := true
+	for i, req := range requests {
+		bucket, ok := store.buckets[req.Key]
+		if !ok {
+			bucket = &tokenBucket{tokens: float64(req.Burst), last: now}
+			store.buckets[req.Key] = bucket
+		}
+		bucket.rate, bucket.burst = req.Rate, req.Burst
+		bucket.refill(now)
+		buckets[i] = bucket
+		allowed = allowed && bucket.tokens >= 1
+	}
+
+	results := make([]RateLimitResult, len(requests))
+	for i, bucket := range buckets {
+		result := RateLimitResult{Limit: bucket.burst, Allowed: bucket.tokens >= 1}
+		if allowed {
+			bucket.tokens--
+		} else if !result.Allowed {
+			result.RetryAfter = secondsToDuration((1 - bucket.tokens) / bucket.rate)
+		}
+		result.Remaining = int(bucket.tokens)
+		result.Reset = secondsToDuration((float64(bucket.burst) - bucket.tokens) / bucket.rate)
+		results[i] = result
+	}
+	return results
+}
+
+// drops the buckets which have refilled since they were last used
+func (store *MemoryRateLimitStore) sweep(now time.Time) {
+	for key, bucket := range store.buckets {
+		if bucket.refill(now); bucket.tokens >= float64(bucket.burst) {
+			delete(store.buckets, key)
+		}
+	}
+	store.lastSweep = now
+}
+
+// adds the tokens earned since the last refill, up to the burst
+func (bucket *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(bucket.last).Seconds(); elapsed > 0 {
+		bucket.tokens = math.Min(float64(bucket.burst), bucket.tokens+elapsed*bucket.rate)
+	}
+	bucket.last = now
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// Where a rate limit stage sits in an endpoint's stages, which decides the limits it enforces
+type rateLimitPhase int
+
+const (
+	rateLimitBeforeAuth      rateLimitPhase = iota // limits keyed by the client's ip or a header
+	rateLimitAfterAuth                             // limits keyed by the principal: sub or apikey
+	rateLimitUnauthenticated                       // every limit, for an endpoint without authentication
+)
+
+// whether a stage in the phase enforces the limit
+func (phase rateLimitPhase) enforces(c config.RateLimit) bool {
+	principal := c.Key == config.RateLimitSub || c.Key == config.RateLimitAPIKey
+	switch phase {
+	case rateLimitBeforeAuth:
+		return !principal
+	case rateLimitAfterAuth:
+		return principal
+	}
+	return true
+}
+
+// A rate limit on each client, across the gateway or for a single endpoint
+type rateLimiter struct {
+	scope  string // global, or endpoint
+	prefix string // of the bucket keys, so that scopes and endpoints don't share buckets
+	config config.RateLimit
+}
+
+func newRateLimiter(scope string, prefix string, c config.RateLimit) *rateLimiter {
+	return &rateLimiter{scope: scope, prefix: prefix, config: c}
+}
+
+// the request for a token from the client's bucket
+func (limiter *rateLimiter) request(r *http.Request) RateLimitRequest {
+	return RateLimitRequest{
+		Key:   limiter.prefix + "|" + limiter.clientKey(r),
+		Rate:  limiter.config.RequestsPerSecond,
+		Burst: limiter.config.Burst,
+	}
+}
+
+// identifies the client of the request, falling back to its ip when it has no principal or header
+func (limiter *rateLimiter) clientKey(r *http.Request) string {
+	var claims map[string]interface{}
+	if state := GetRequestState(r); nil != state {
+		claims = state.Claims
+	}
+
+	switch limiter.config.Key {
+	case config.RateLimitSub:
+		if sub, ok := claims["sub"].(string); ok && sub != "" {
+			return "sub:" + sub
+		}
+	case config.RateLimitAPIKey:
+		if keyID, ok := claims["key_id"].(string); ok && keyID != "" {
+			return "apikey:" + keyID
+		}
+	case config.RateLimitHeader:
+		if v := r.Header.Get(limiter.config.Header); v != "" {
+			return "header:" + v
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// Creates a StageHandler which limits the rate of each client's requests to the endpoint, and across the gateway
+// when a global limit is set, for the limits the phase enforces. It is the next stage when there are none
+func (d *Dispatcher) newRateLimitStageHandler(ep config.Endpoint, rc routeConfig, phase rateLimitPhase, next *StageHandler) *StageHandler {
+	var limiters []*rateLimiter
+	if nil != ep.RateLimit && phase.enforces(*ep.RateLimit) {
+		limiters = append(limiters, newRateLimiter("endpoint", "endpoint:"+ep.Name, *ep.RateLimit))
+	}
+	if nil != rc.rateLimit && phase.enforces(*rc.rateLimit) {
+		limiters = append(limiters, newRateLimiter("global", "global", *rc.rateLimit))
+	}
+	if len(limiters) == 0 {
+		return next
+	}
+
+	return &StageHandler{
+		Next: next,
+		ExecHandler: func(w http.ResponseWriter, r *http.Request) bool {
+			requests := make([]RateLimitRequest, len(limiters))
+			for i, limiter := range limiters {
+				requests[i] = limiter.request(r)
+			}
+			results := d.rateLimitStore.Take(requests...)
+
+			// the client is told about the limit it is closest to, or the one which refused it
+			tightest := results[0]
+			for i, result := range results {
+				if !result.Allowed {
+					tightest = result
+					d.metrics.rateLimited.Inc(ep.Name, limiters[i].scope)
+					break
+				}
+				if result.Remaining < tightest.Remaining {
+					tightest = result
+				}
+			}
+
+			setRateLimitHeaders(w.Header(), tightest)
+			if !tightest.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(tightest.RetryAfter)))
+				d.sendError(w, httperr.TooManyRequests)
+				return false
+			}
+			return true
+		},
+	}
+}
+
+// the RateLimit-* response headers, as in the ietf draft. An allowed request keeps the headers an earlier rate
+// limit stage set, when its limit is the one the client is closer to
+func setRateLimitHeaders(h http.Header, result RateLimitResult) {
+	if remaining, err := strconv.Atoi(h.Get("RateLimit-Remaining")); nil == err && result.Allowed && remaining <= result.Remaining {
+		return
+	}
+	h.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+}
+
+// whole seconds, rounded up so that a client waiting that long isn't refused again
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,219 @@
+package gateway
+
+import (
+	"github.com/seansitter/gogw/config"
+	"github.com/seansitter/gogw/metrics"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// takes a token from a single bucket
+func takeOne(store *MemoryRateLimitStore, key string, rate float64, burst int, now time.Time) RateLimitResult {
+	return store.take(now, RateLimitRequest{key, rate, burst})[0]
+}
+
+func TestTokenBucketBurstAndRefill(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	now := time.Now()
+
+	// the bucket starts full, so the burst is allowed at once
+	for i := 0; i < 3; i++ {
+		result := takeOne(store, "client", 1, 3, now)
+		if !result.Allowed {
+			t.Fatalf("request %v of the burst was refused", i+1)
+		}
+		if result.Remaining != 2-i {
+			t.Errorf("expected %v remaining, got: %v", 2-i, result.Remaining)
+		}
+	}
+
+	result := takeOne(store, "client", 1, 3, now)
+	if result.Allowed {
+		t.Fatal("expected the request over the burst to be refused")
+	}
+	if result.RetryAfter != time.Second {
+		t.Errorf("expected to retry after a second, got: %v", result.RetryAfter)
+	}
+	if result.Reset != 3*time.Second {
+		t.Errorf("expected the bucket to be full in 3s, got: %v", result.Reset)
+	}
+
+	// a token is earned each second
+	if result := takeOne(store, "client", 1, 3, now.Add(time.Second)); !result.Allowed {
+		t.Error("expected the refilled token to be allowed")
+	}
+	if result := takeOne(store, "client", 1, 3, now.Add(time.Second)); result.Allowed {
+		t.Error("expected only one token to have refilled")
+	}
+
+	// other clients have their own buckets
+	if result := takeOne(store, "other", 1, 3, now); !result.Allowed {
+		t.Error("expected another client to be allowed")
+	}
+}
+
+func TestTokenBucketSweep(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	now := time.Now()
+
+	takeOne(store, "idle", 10, 10, now)
+	takeOne(store, "busy", 0.01, 1, now)
+
+	// the idle bucket has refilled by the sweep, the busy one hasn't
+	takeOne(store, "other", 10, 10, now.Add(rateLimitSweepInterval))
+	if _, ok := store.buckets["idle"]; ok {
+		t.Error("expected the refilled bucket to be swept")
+	}
+	if _, ok := store.buckets["busy"]; !ok {
+		t.Error("expected the bucket which hasn't refilled to be kept")
+	}
+}
+
+func TestRateLimitStage(t *testing.T) {
+	d := new(Dispatcher)
+	d.metrics = newGatewayMetrics(metrics.NewRegistry(), d)
+	d.rateLimitStore = NewMemoryRateLimitStore()
+
+	proxied := 0
+	next := &StageHandler{ExecHandler: func(w http.ResponseWriter, r *http.Request) bool {
+		proxied++
+		return false
+	}}
+
+	ep := config.Endpoint{Name: "limited", RateLimit: &config.RateLimit{RequestsPerSecond: 1, Burst: 2, Key: config.RateLimitHeader, Header: "X-Client"}}
+	sh := d.newRateLimitStageHandler(ep, routeConfig{}, rateLimitUnauthenticated, next)
+
+	request := func(client string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/limited", nil)
+		r.Header.Set("X-Client", client)
+		w := httptest.NewRecorder()
+		sh.Execute(w, r)
+		return w
+	}
+
+	request("a")
+	w := request("a")
+	if w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "2" || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("expected the burst to be allowed with the limit headers, got: %v %v", w.Code, w.Header())
+	}
+
+	w = request("a")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected a 429 over the limit, got: %v", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "1" {
+		t.Errorf("expected Retry-After: 1, got: %v", w.Header().Get("Retry-After"))
+	}
+	if proxied != 2 {
+		t.Errorf("expected the refused request not to be proxied, proxied: %v", proxied)
+	}
+
+	if w = request("b"); w.Code != http.StatusOK {
+		t.Errorf("expected another client to be allowed, got: %v", w.Code)
+	}
+}
+
+func TestRateLimitStageWithoutLimits(t *testing.T) {
+	d := new(Dispatcher)
+	next := &StageHandler{}
+	if sh := d.newRateLimitStageHandler(config.Endpoint{Name: "unlimited"}, routeConfig{}, rateLimitUnauthenticated, next); sh != next {
+		t.Error("expected no rate limit stage without a limit")
+	}
+}
+
+func TestRateLimitPhases(t *testing.T) {
+	d := new(Dispatcher)
+	next := &StageHandler{}
+	ipLimit := &config.RateLimit{RequestsPerSecond: 1, Burst: 1, Key: config.RateLimitIP}
+	subLimit := &config.RateLimit{RequestsPerSecond: 1, Burst: 1, Key: config.RateLimitSub}
+
+	tests := []struct {
+		endpoint *config.RateLimit
+		global   *config.RateLimit
+		phase    rateLimitPhase
+		limited  bool
+	}{
+		// ip limits shed floods of bad credentials before authentication
+		{ipLimit, nil, rateLimitBeforeAuth, true},
+		{ipLimit, nil, rateLimitAfterAuth, false},
+		{nil, ipLimit, rateLimitBeforeAuth, true},
+		// principal limits need the claims of authentication
+		{subLimit, nil, rateLimitBeforeAuth, false},
+		{subLimit, nil, rateLimitAfterAuth, true},
+		{nil, subLimit, rateLimitAfterAuth, true},
+		{ipLimit, subLimit, rateLimitUnauthenticated, true},
+	}
+	for i, test := range tests {
+		ep := config.Endpoint{Name: "limited", RateLimit: test.endpoint}
+		sh := d.newRateLimitStageHandler(ep, routeConfig{rateLimit: test.global}, test.phase, next)
+		if limited := sh != next; limited != test.limited {
+			t.Errorf("test %v: expected a rate limit stage: %v, got: %v", i, test.limited, limited)
+		}
+	}
+}
+
+func TestTokenBucketsTakenTogether(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	now := time.Now()
+	endpoint := RateLimitRequest{"endpoint", 1, 5}
+	global := RateLimitRequest{"global", 1, 1}
+
+	if results := store.take(now, endpoint, global); !results[0].Allowed || !results[1].Allowed {
+		t.Fatalf("expected the first request to be allowed, got: %+v", results)
+	}
+
+	// the global limit refuses the request, so the endpoint's token isn't taken
+	results := store.take(now, endpoint, global)
+	if !results[0].Allowed || results[1].Allowed {
+		t.Fatalf("expected only the global limit to refuse the request, got: %+v", results)
+	}
+	if results[0].Remaining != 4 || results[0].RetryAfter != 0 {
+		t.Errorf("expected the endpoint bucket to keep its 4 tokens, got: %+v", results[0])
+	}
+	if results[1].RetryAfter != time.Second {
+		t.Errorf("expected to retry after a second, got: %v", results[1].RetryAfter)
+	}
+	if tokens := store.buckets["endpoint"].tokens; tokens != 4 {
+		t.Errorf("expected 4 tokens in the endpoint bucket, got: %v", tokens)
+	}
+}
+
+func TestRateLimitStageWithBothLimits(t *testing.T) {
+	d := new(Dispatcher)
+	d.metrics = newGatewayMetrics(metrics.NewRegistry(), d)
+	store := NewMemoryRateLimitStore()
+	d.rateLimitStore = store
+
+	ep := config.Endpoint{Name: "limited", RateLimit: &config.RateLimit{RequestsPerSecond: 1, Burst: 5, Key: config.RateLimitIP}}
+	rc := routeConfig{rateLimit: &config.RateLimit{RequestsPerSecond: 1, Burst: 2, Key: config.RateLimitIP}}
+	sh := d.newRateLimitStageHandler(ep, rc, rateLimitUnauthenticated, &StageHandler{ExecHandler: func(w http.ResponseWriter, r *http.Request) bool {
+		return false
+	}})
+
+	request := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		sh.Execute(w, httptest.NewRequest(http.MethodGet, "/limited", nil))
+		return w
+	}
+
+	// the client is told about the global limit, which it is closer to
+	if w := request(); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "2" || w.Header().Get("RateLimit-Remaining") != "1" {
+		t.Fatalf("expected the global limit's headers, got: %v %v", w.Code, w.Header())
+	}
+	request()
+	for i := 0; i < 3; i++ {
+		if w := request(); w.Code != http.StatusTooManyRequests || w.Header().Get("RateLimit-Limit") != "2" {
+			t.Fatalf("expected the global limit to refuse the request, got: %v %v", w.Code, w.Header())
+		}
+	}
+
+	// the refused requests didn't use up the endpoint's quota
+	for key, bucket := range store.buckets {
+		if strings.HasPrefix(key, "endpoint:") && int(bucket.tokens) != 3 {
+			t.Errorf("expected 3 tokens left for the endpoint, got: %v", bucket.tokens)
+		}
+	}
+}
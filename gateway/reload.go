@@ -0,0 +1,77 @@
+package gateway
+
+import (
+	"github.com/seansitter/gogw/config"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"reflect"
+	"time"
+)
+
+// Re-reads the config file and swaps the new routes into the dispatcher. A config which fails to
+// parse or validate is logged and rejected, and the current routes stay live.
+func (s *GwServer) Reload() error {
+	// the whole reload is serialized, so that the routes and the effective config are those of the same file
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	if s.config.Path == "" {
+		log.Warn("config was not loaded from a file, nothing to reload")
+		return nil
+	}
+
+	c, err := config.ParseFile(s.config.Path)
+	if nil != err {
+		log.Errorf("rejected config reload from: %v, %v", s.config.Path, err)
+		return err
+	}
+
+	if err := s.dispatcher.Reload(c); nil != err {
+		log.Errorf("rejected config reload from: %v, %v", s.config.Path, err)
+		return err
+	}
+
+	// only the routes are swapped, anything else needs a restart to take effect
+	if !reflect.DeepEqual(s.config.Server, c.Server) || !reflect.DeepEqual(s.config.Gateway, c.Gateway) {
+		log.Warn("server and gateway config changes require a restart and were not applied")
+	}
+
+	effective := *s.currentConfig()
+	effective.Endpoints, effective.Proxy, effective.CircuitBreaker, effective.RateLimit = c.Endpoints, c.Proxy, c.CircuitBreaker, c.RateLimit
+	s.effective.Store(&effective)
+
+	for _, e := range c.Endpoints {
+		log.Infof("reloaded endpoint: %s", e)
+	}
+
+	return nil
+}
+
+// Polls the config file for changes, reloading whenever its modification time moves
+func (s *GwServer) watchConfig() {
+	lastMod := modTime(s.config.Path)
+	ticker := time.NewTicker(s.config.Gateway.ConfigPollIntervalMs * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if mod := modTime(s.config.Path); !mod.Equal(lastMod) {
+				log.Infof("config file: %v changed, reloading", s.config.Path)
+				lastMod = mod
+				s.Reload()
+			}
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// the modification time of a file, or the zero time if it can't be read
+func modTime(path string) time.Time {
+	fi, err := os.Stat(path)
+	if nil != err {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
@@ -0,0 +1,45 @@
+package gateway
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+// the header a request's id is taken from, forwarded upstream in and returned to the client in
+const RequestIDHeader = "X-Request-Id"
+
+// the longest incoming request id which is kept
+const maxRequestIDLen = 128
+
+// Returns the request's incoming id, or a new one when it has none or it isn't usable
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(RequestIDHeader); validRequestID(id) {
+		return id
+	}
+	return newRequestID()
+}
+
+// ids are logged and forwarded, so only printable ascii without spaces is accepted
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// a random (v4) uuid
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); nil != err {
+		panic(fmt.Sprintf("failed to read random bytes for a request id: %v", err))
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
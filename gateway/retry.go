@@ -0,0 +1,190 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"github.com/seansitter/gogw/config"
+	gwlog "github.com/seansitter/gogw/log"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// the window over which the retry budget is measured
+const retryBudgetWindow = 10 * time.Second
+
+// methods which are safe to send more than once
+var idempotentMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+	"TRACE":   true,
+	"PUT":     true,
+	"DELETE":  true,
+}
+
+// Limits retries to a percentage of the requests over a window, so that a failing endpoint
+// doesn't see its load multiplied by retry storms
+type RetryBudget struct {
+	percent     float64
+	minRetries  int
+	windowStart time.Time
+	requests    int
+	retries     int
+	lock        sync.Mutex
+}
+
+func newRetryBudget(retryConfig config.Retry) *RetryBudget {
+	return &RetryBudget{
+		percent:     retryConfig.BudgetPercent,
+		minRetries:  retryConfig.MinRetriesPerSec * int(retryBudgetWindow/time.Second),
+		windowStart: time.Now(),
+	}
+}
+
+// starts a new window when the current one has passed
+func (b *RetryBudget) roll(now time.Time) {
+	if now.Sub(b.windowStart) >= retryBudgetWindow {
+		b.windowStart = now
+		b.requests = 0
+		b.retries = 0
+	}
+}
+
+// records a request
+func (b *RetryBudget) request() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.roll(time.Now())
+	b.requests++
+}
+
+// takes a retry from the budget, returning false when it is spent
+func (b *RetryBudget) withdraw() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.roll(time.Now())
+
+	if b.retries >= b.minRetries && float64(b.retries) >= float64(b.requests)*b.percent/100 {
+		return false
+	}
+	b.retries++
+	return true
+}
+
+// Retries idempotent requests through a CbTransport. Each attempt goes through the circuit breaker,
+// so each counts once against it, and retries stop as soon as the breaker rejects a request.
+type RetryTransport struct {
+	Transport *CbTransport
+	config    config.Retry
+	statuses  map[int]bool
+	budget    *RetryBudget
+}
+
+func newRetryTransport(transport *CbTransport, retryConfig config.Retry, budget *RetryBudget) *RetryTransport {
+	statuses := make(map[int]bool)
+	for _, status := range retryConfig.Statuses {
+		statuses[status] = true
+	}
+
+	return &RetryTransport{transport, retryConfig, statuses, budget}
+}
+
+// whether the request may be sent again, it must be idempotent with a body that can be replayed
+func retryable(request *http.Request) bool {
+	if !idempotentMethods[request.Method] {
+		return false
+	}
+	return nil == request.Body || request.Body == http.NoBody || nil != request.GetBody
+}
+
+// whether the error is a failure to connect, or a connection dropped before a response
+func isConnectError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// whether the outcome of an attempt should be retried
+func (transport *RetryTransport) shouldRetry(resp *http.Response, err error) bool {
+	if nil == err {
+		return transport.statuses[resp.StatusCode]
+	}
+
+	// the breaker rejected the request, retrying would only be rejected again
+	var rejectedErr BreakerRejectedError
+	if errors.As(err, &rejectedErr) {
+		return false
+	}
+
+	var statusErr StatusError
+	if errors.As(err, &statusErr) {
+		return transport.statuses[statusErr.StatusCode]
+	}
+
+	return transport.config.ConnectErrors && isConnectError(err)
+}
+
+// exponential backoff with full jitter
+func (transport *RetryTransport) backoff(retry int) time.Duration {
+	backoff := transport.config.BaseBackoffMs * time.Millisecond << uint(retry)
+	if max := transport.config.MaxBackoffMs * time.Millisecond; backoff > max || backoff <= 0 {
+		backoff = max
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+func (transport *RetryTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	transport.budget.request()
+
+	resp, err := transport.Transport.RoundTrip(request)
+	if !retryable(request) {
+		return resp, err
+	}
+
+	for retry := 0; retry < transport.config.Attempts && transport.shouldRetry(resp, err); retry++ {
+		if !transport.budget.withdraw() {
+			gwlog.FromContext(request.Context()).Debugf("retry budget spent, not retrying %v %v", request.Method, request.URL)
+			break
+		}
+
+		// wait out the backoff, unless the client goes away first
+		select {
+		case <-time.After(transport.backoff(retry)):
+		case <-request.Context().Done():
+			return resp, err
+		}
+
+		attempt := request
+		if nil != request.GetBody {
+			body, bodyErr := request.GetBody()
+			if nil != bodyErr {
+				return resp, err
+			}
+			attempt = request.Clone(request.Context())
+			attempt.Body = body
+		}
+
+		// the response being retried is discarded
+		if nil != resp {
+			resp.Body.Close()
+		}
+
+		gwlog.FromContext(request.Context()).Debugf("retrying %v %v, attempt: %v, after: %v", request.Method, request.URL, retry+1, err)
+		resp, err = transport.Transport.RoundTrip(attempt)
+	}
+
+	return resp, err
+}
@@ -0,0 +1,75 @@
+package gateway
+
+import (
+	"github.com/seansitter/gogw/config"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+type rewriteRule struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+// Rewrites the request path for an endpoint before it is proxied, so that endpoints don't need to
+// know where they are mounted on the gateway. The prefix is stripped first, then the rewrite rules
+// are applied in order, then the prefix is added.
+type PathRewriter struct {
+	stripPrefix string
+	addPrefix   string
+	rules       []rewriteRule
+}
+
+// Instantiates a PathRewriter, returns nil if the endpoint has no rewriting configured
+func newPathRewriter(ep config.Endpoint) (*PathRewriter, error) {
+	if ep.StripPrefix == "" && ep.AddPrefix == "" && len(ep.Rewrite) == 0 {
+		return nil, nil
+	}
+
+	rules := make([]rewriteRule, len(ep.Rewrite))
+	for i, rule := range ep.Rewrite {
+		re, err := regexp.Compile(rule.Match)
+		if nil != err {
+			return nil, err
+		}
+		rules[i] = rewriteRule{re, rule.Replace}
+	}
+
+	return &PathRewriter{ep.StripPrefix, ep.AddPrefix, rules}, nil
+}
+
+// Returns the rewritten path
+func (pr *PathRewriter) RewritePath(path string) string {
+	// the prefix is only stripped on a segment boundary, ie /svc strips /svc/users but not /svcusers
+	if prefix := strings.TrimSuffix(pr.stripPrefix, "/"); prefix != "" && strings.HasPrefix(path, prefix) {
+		if rest := path[len(prefix):]; rest == "" || strings.HasPrefix(rest, "/") {
+			path = rest
+		}
+	}
+
+	for _, rule := range pr.rules {
+		path = rule.match.ReplaceAllString(path, rule.replace)
+	}
+
+	if pr.addPrefix != "" {
+		path = strings.TrimSuffix(pr.addPrefix, "/") + "/" + strings.TrimPrefix(path, "/")
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	return path
+}
+
+// Returns a copy of the request with its path rewritten, the original is left untouched
+func (pr *PathRewriter) Rewrite(r *http.Request) *http.Request {
+	u := *r.URL
+	u.Path = pr.RewritePath(r.URL.Path)
+	u.RawPath = "" // re-derived from the new path
+
+	rewritten := r.WithContext(r.Context())
+	rewritten.URL = &u
+	return rewritten
+}
@@ -0,0 +1,226 @@
+package gateway
+
+import (
+	"context"
+	"github.com/seansitter/gogw/config"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Returns the path template captures for the route which matched the request, ie {id}
+func PathParams(r *http.Request) map[string]string {
+	params, _ := r.Context().Value(pathParamsKey).(map[string]string)
+	return params
+}
+
+// Matches a request against a single route's predicates
+type routeMatcher struct {
+	route    Route
+	hosts    []string
+	segments []string
+	methods  map[string]bool
+	headers  map[string]string
+	query    map[string]string
+	order    int // position in the config, the final tie breaker
+}
+
+func newRouteMatcher(route Route, order int) *routeMatcher {
+	m := route.Endpoint.RouteMatch()
+
+	rm := &routeMatcher{
+		route:    route,
+		segments: config.PathSegments(m.Path),
+		methods:  make(map[string]bool),
+		headers:  make(map[string]string),
+		query:    m.Query,
+		order:    order,
+	}
+
+	for _, h := range m.Hosts {
+		rm.hosts = append(rm.hosts, strings.ToLower(h))
+	}
+	for _, method := range m.Methods {
+		rm.methods[strings.ToUpper(method)] = true
+	}
+	for k, v := range m.Headers {
+		rm.headers[http.CanonicalHeaderKey(k)] = v
+	}
+
+	return rm
+}
+
+// Scores how specifically the route's hosts match the request host: 0 when the route accepts any host,
+// exact matches beat wildcards, and longer wildcards beat shorter ones. -1 when no host matches.
+func (rm *routeMatcher) hostScore(host string) int {
+	if len(rm.hosts) == 0 {
+		return 0
+	}
+
+	best := -1
+	for _, h := range rm.hosts {
+		if h == host {
+			return 1 << 16
+		}
+		if strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:]) && len(h) > best {
+			best = len(h)
+		}
+	}
+
+	return best
+}
+
+// Matches the route's path prefix against the request path segments, returning template captures
+func (rm *routeMatcher) matchPath(segments []string) (map[string]string, bool) {
+	if len(segments) < len(rm.segments) {
+		return nil, false
+	}
+
+	var params map[string]string
+	for i, s := range rm.segments {
+		if config.IsTemplateSegment(s) {
+			if nil == params {
+				params = make(map[string]string)
+			}
+			params[s[1:len(s)-1]] = segments[i]
+		} else if s != segments[i] {
+			return nil, false
+		}
+	}
+
+	return params, true
+}
+
+// matches the header and query predicates
+func (rm *routeMatcher) matchPredicates(r *http.Request) bool {
+	if len(rm.methods) > 0 && !rm.methods[r.Method] {
+		return false
+	}
+
+	for k, v := range rm.headers {
+		if vals, ok := r.Header[k]; !ok || (v != "" && !contains(vals, v)) {
+			return false
+		}
+	}
+
+	if len(rm.query) > 0 {
+		q := r.URL.Query()
+		for k, v := range rm.query {
+			if vals, ok := q[k]; !ok || (v != "" && !contains(vals, v)) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func contains(vals []string, v string) bool {
+	for _, val := range vals {
+		if val == v {
+			return true
+		}
+	}
+	return false
+}
+
+// the number of literal (non-template) segments in the path prefix
+func (rm *routeMatcher) literalSegments() int {
+	n := 0
+	for _, s := range rm.segments {
+		if !config.IsTemplateSegment(s) {
+			n++
+		}
+	}
+	return n
+}
+
+// Matches requests to routes. Candidates are ordered by path specificity so that the first match
+// is the best one, with host specificity compared across all path matches.
+type Router struct {
+	matchers []*routeMatcher
+}
+
+// Instantiates a router over the routes, in config order
+func newRouter(routes []Route) *Router {
+	matchers := make([]*routeMatcher, len(routes))
+	for i, route := range routes {
+		matchers[i] = newRouteMatcher(route, i)
+	}
+
+	// longest prefix first, then literal segments over templates, then method filters, then more predicates
+	sort.SliceStable(matchers, func(i, j int) bool {
+		a, b := matchers[i], matchers[j]
+		if len(a.segments) != len(b.segments) {
+			return len(a.segments) > len(b.segments)
+		}
+		if a.literalSegments() != b.literalSegments() {
+			return a.literalSegments() > b.literalSegments()
+		}
+		if (len(a.methods) > 0) != (len(b.methods) > 0) {
+			return len(a.methods) > 0
+		}
+		if len(a.headers)+len(a.query) != len(b.headers)+len(b.query) {
+			return len(a.headers)+len(a.query) > len(b.headers)+len(b.query)
+		}
+		return a.order < b.order
+	})
+
+	return &Router{matchers}
+}
+
+// Returns the best matching route for the request along with its path captures, or nil when there is none.
+// Host specificity takes priority, then the path ordering of the matchers. Disabled routes are skipped.
+func (router *Router) Match(r *http.Request) (*Route, map[string]string) {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); nil == err {
+		host = h
+	}
+	segments := config.PathSegments(r.URL.Path)
+
+	var best *routeMatcher
+	var bestParams map[string]string
+	bestHost := -1
+
+	for _, rm := range router.matchers {
+		if rm.route.control.State() == RouteDisabled {
+			continue
+		}
+
+		hostScore := rm.hostScore(host)
+		if hostScore <= bestHost {
+			continue // a more specific host has already matched
+		}
+
+		params, ok := rm.matchPath(segments)
+		if !ok || !rm.matchPredicates(r) {
+			continue
+		}
+
+		best, bestParams, bestHost = rm, params, hostScore
+	}
+
+	if nil == best {
+		return nil, nil
+	}
+
+	return &best.route, bestParams
+}
+
+// Returns the routes in priority order
+func (router *Router) Routes() []Route {
+	routes := make([]Route, len(router.matchers))
+	for i, rm := range router.matchers {
+		routes[i] = rm.route
+	}
+	return routes
+}
+
+// attaches the path captures to the request context
+func withPathParams(r *http.Request, params map[string]string) *http.Request {
+	if nil == params {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), pathParamsKey, params))
+}
@@ -3,15 +3,19 @@ package gateway
 import (
 	"context"
 	"errors"
-	"github.com/dgrijalva/jwt-go"
+	"fmt"
 	"github.com/seansitter/gogw/auth"
 	"github.com/seansitter/gogw/config"
-	"github.com/seansitter/gogw/res"
+	gwlog "github.com/seansitter/gogw/log"
+	"github.com/seansitter/gogw/metrics"
 	log "github.com/sirupsen/logrus"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -20,56 +24,251 @@ const numAuthWorkers = 8
 
 // Gateway definition
 type GwServer struct {
-	httpServer http.Server
+	httpServer  *http.Server
+	adminServer *http.Server // nil when there is no admin port
+	dispatcher  *Dispatcher
+	config      config.Config
+	effective   atomic.Value // *config.Config, the startup config with the routes of the last reload
+	reloadLock  sync.Mutex   // serializes reloads, ie a SIGHUP while the config file poller is reloading
+	keys        auth.KeyProvider
+	authPool    *auth.WorkerPool
+	metrics     *metrics.Registry
+	accessLog   *gwlog.AccessLogger // nil when there is no access log
+	stopChan    chan bool
+	stopOnce    sync.Once
+	stopErr     error // the result of the shutdown, returned by every call to Shutdown
 }
 
-// Reads and decodes a pem file from the asset path
-func newRSAPublicKey(PEMAssetPath string) (interface{}, error) {
-	if PEMAssetPath == "" {
+// Reads and decodes a public key pem file from the filesystem, or the asset path
+func newPublicKey(PEMPath string, keyType string) (interface{}, error) {
+	if PEMPath == "" {
 		return nil, errors.New("no pemfile set on config gateway")
 	}
 
-	// load the pem from the asset path
-	pemCtnt := res.MustAsset(PEMAssetPath)
-	pk, err := jwt.ParseRSAPublicKeyFromPEM(pemCtnt)
+	// load the pem from the filesystem, falling back to the asset path
+	pemCtnt, err := config.ReadResource(PEMPath)
 	if nil != err {
 		return nil, err
 	}
 
-	return pk, nil
+	return auth.ParsePublicKeyPEM(pemCtnt, keyType)
 }
 
-// The dispatcher is the primary handler or the server
-func newDispatcher(config config.Config) (*Dispatcher, error) {
-	key, err := newRSAPublicKey(config.Gateway.PEMFile)
+// Reads an hmac secret from a file or env var
+func newHMACSecret(secretFile string, secretEnv string) ([]byte, error) {
+	var secret string
+	if secretEnv != "" {
+		secret = os.Getenv(secretEnv)
+	} else {
+		ctnt, err := config.ReadResource(secretFile)
+		if nil != err {
+			return nil, err
+		}
+		secret = strings.TrimSpace(string(ctnt))
+	}
+
+	if secret == "" {
+		return nil, errors.New("hmac secret is empty")
+	}
+	return []byte(secret), nil
+}
+
+// The keys tokens are verified with, from a jwks when configured or else the pem file
+func newKeyProvider(c config.Config) (auth.KeyProvider, error) {
+	if jwks := c.Gateway.JWKS; nil != jwks {
+		refresh := jwks.RefreshIntervalMs * time.Millisecond
+		if jwks.URL != "" {
+			return auth.NewJWKSKeySet(jwks.URL, auth.JWKSURLFetcher(jwks.URL, jwks.TimeoutMs*time.Millisecond), refresh)
+		}
+
+		path := c.ResolvePath(jwks.File)
+		return auth.NewJWKSKeySet(path, func() ([]byte, error) {
+			return config.ReadResource(path)
+		}, refresh)
+	}
+
+	if c.Gateway.KeyType == auth.KeyTypeHMAC {
+		secret, err := newHMACSecret(c.ResolvePath(c.Gateway.HMACSecretFile), c.Gateway.HMACSecretEnv)
+		if nil != err {
+			return nil, err
+		}
+		return auth.NewStaticKey(secret), nil
+	}
+
+	key, err := newPublicKey(c.ResolvePath(c.Gateway.PEMFile), c.Gateway.KeyType)
 	if nil != err {
 		return nil, err
 	}
+	return auth.NewStaticKey(key), nil
+}
 
-	log.Infof("using %v auth workers", config.Gateway.AuthWorkers)
-	authHandler, err := auth.NewPooledJWTAuthHandler(config.Gateway.AuthWorkers, key)
-	//authHandler, err := auth.NewJWTAuthHandler(key)
+// Whether tokens can be verified, ie a key source is configured or an endpoint uses jwt auth
+func jwtConfigured(c config.Config) bool {
+	if c.Gateway.PEMFile != "" || nil != c.Gateway.JWKS || c.Gateway.KeyType == auth.KeyTypeHMAC {
+		return true
+	}
+	for _, ep := range c.Endpoints {
+		if ep.AuthSchemes().Has(config.AuthJWT) {
+			return true
+		}
+	}
+	return false
+}
+
+// The api key auth handler, with the key store loaded from the filesystem or the asset path
+func newAPIKeyAuthHandler(c config.Config) (auth.AuthHandler, error) {
+	ctnt, err := config.ReadResource(c.ResolvePath(c.Gateway.APIKeys.File))
 	if nil != err {
 		return nil, err
 	}
 
-	dispatcher := NewDispatchBuilder().
-		ProxyConfig(config.Proxy).
-		CircuitBreakerConfig(config.CircuitBreaker).
-		Endpoints(config.Endpoints).
-		AuthHandler(authHandler).
-		Build()
+	store, err := auth.ParseAPIKeyStore(ctnt)
+	if nil != err {
+		return nil, err
+	}
 
-	return dispatcher, nil
+	return auth.NewAPIKeyAuthHandler(auth.NewAPIKeyAuthenticator(store), c.Gateway.APIKeys.Header, c.Gateway.APIKeys.QueryParam)
+}
+
+// The introspection auth handler, run on the auth worker pool
+func newIntrospectionAuthHandler(c config.Config, pool *auth.WorkerPool) (auth.AuthHandler, error) {
+	introspection := c.Gateway.Introspection
+	clientSecret := introspection.ClientSecret
+	if introspection.ClientSecretEnv != "" {
+		clientSecret = os.Getenv(introspection.ClientSecretEnv)
+	}
+
+	return auth.NewPooledIntrospectionAuthHandler(pool, auth.IntrospectionConfig{
+		URL:          introspection.URL,
+		ClientID:     introspection.ClientID,
+		ClientSecret: clientSecret,
+		Timeout:      introspection.TimeoutMs * time.Millisecond,
+		CacheSize:    introspection.CacheSize,
+		MaxCacheTTL:  introspection.MaxCacheMs * time.Millisecond,
+		InactiveTTL:  introspection.InactiveCacheMs * time.Millisecond,
+	})
+}
+
+// The jwt auth handler, run on the auth worker pool
+func newJWTAuthHandler(config config.Config, keys auth.KeyProvider, pool *auth.WorkerPool) (auth.AuthHandler, error) {
+	// only the algorithms of the key's type are allowed, unless others are configured
+	algorithms := config.Gateway.JWT.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = auth.DefaultAlgorithms(keys)
+	}
+
+	validation := auth.JWTValidation{
+		Algorithms:     algorithms,
+		Issuer:         config.Gateway.JWT.Issuer,
+		Audience:       config.Gateway.JWT.Audience,
+		RequiredClaims: config.Gateway.JWT.RequiredClaims,
+		Leeway:         config.Gateway.JWT.LeewayMs * time.Millisecond,
+		CacheSize:      config.Gateway.JWT.CacheSize,
+	}
+
+	return auth.NewPooledJWTAuthHandler(pool, keys, validation)
+	//return auth.NewJWTAuthHandler(keys, validation)
+}
+
+// The dispatcher is the primary handler or the server. The built in auth handlers are registered alongside any
+// already in the registry
+func newDispatcher(c config.Config, keys auth.KeyProvider, reg *auth.Registry, pool *auth.WorkerPool, metricsReg *metrics.Registry, accessLog *gwlog.AccessLogger) (*Dispatcher, error) {
+	if nil != keys {
+		authHandler, err := newJWTAuthHandler(c, keys, pool)
+		if nil != err {
+			return nil, err
+		}
+		if err := reg.Register(config.AuthJWT, authHandler); nil != err {
+			return nil, err
+		}
+	}
+
+	if nil != c.Gateway.APIKeys {
+		authHandler, err := newAPIKeyAuthHandler(c)
+		if nil != err {
+			return nil, err
+		}
+		if err := reg.Register(config.AuthAPIKey, authHandler); nil != err {
+			return nil, err
+		}
+	}
+
+	if nil != c.Gateway.Introspection {
+		authHandler, err := newIntrospectionAuthHandler(c, pool)
+		if nil != err {
+			return nil, err
+		}
+		if err := reg.Register(config.AuthIntrospection, authHandler); nil != err {
+			return nil, err
+		}
+	}
+
+	// every scheme an endpoint accepts must have a handler
+	for _, ep := range c.Endpoints {
+		if !ep.Authenticated() {
+			continue
+		}
+		if _, err := reg.Chain(ep.AuthSchemes()); nil != err {
+			return nil, errors.New(fmt.Sprintf("failed to configure auth for endpoint: %v, %v", ep.Name, err))
+		}
+	}
+
+	return NewDispatchBuilder().
+		ProxyConfig(c.Proxy).
+		CircuitBreakerConfig(c.CircuitBreaker).
+		RateLimit(c.RateLimit).
+		Endpoints(c.Endpoints).
+		AuthRegistry(reg).
+		Metrics(metricsReg).
+		AccessLog(accessLog).
+		Build()
 }
 
 func NewServer(config config.Config) (*GwServer, error) {
-	dispatcher, err := newDispatcher(config)
+	return NewServerWithAuth(config, auth.NewRegistry())
+}
+
+// Instantiates a server whose endpoints may use the custom auth handlers of the registry, for when gogw is
+// embedded as a library. The built in jwt, apikey and introspection schemes are registered as configured
+func NewServerWithAuth(config config.Config, reg *auth.Registry) (*GwServer, error) {
+	var keys auth.KeyProvider
+	if jwtConfigured(config) {
+		var err error
+		if keys, err = newKeyProvider(config); nil != err {
+			return nil, err
+		}
+	}
+
+	// the authenticators which are expensive to run share a worker pool
+	log.Infof("using %v auth workers", config.Gateway.AuthWorkers)
+	queueDepth := config.Gateway.AuthQueueDepth
+	if queueDepth < 0 {
+		queueDepth = 0
+	}
+	pool := auth.NewWorkerPool(config.Gateway.AuthWorkers, queueDepth, config.Gateway.AuthQueueTimeoutMs*time.Millisecond)
+
+	metricsReg := metrics.NewRegistry()
+	registerAuthPoolMetrics(metricsReg, pool, config.Gateway.AuthWorkers)
+
+	var accessLog *gwlog.AccessLogger
+	if c := config.AccessLog; nil != c {
+		var err error
+		if accessLog, err = gwlog.NewAccessLogger(c.Format, c.File, c.SampleRate, c.ExcludePaths); nil != err {
+			pool.Stop()
+			return nil, err
+		}
+	}
+
+	dispatcher, err := newDispatcher(config, keys, reg, pool, metricsReg, accessLog)
 	if nil != err {
+		pool.Stop()
+		if nil != accessLog {
+			accessLog.Close()
+		}
 		return nil, err
 	}
 
-	s := http.Server{
+	s := &http.Server{
 		Addr:           ":" + strconv.Itoa(config.Server.Port),
 		Handler:        dispatcher,
 		ReadTimeout:    config.Server.ReadTimeoutMs * time.Millisecond,
@@ -77,14 +276,46 @@ func NewServer(config config.Config) (*GwServer, error) {
 		MaxHeaderBytes: 1 << 20,
 	}
 
-	return &GwServer{s}, nil
+	gw := &GwServer{httpServer: s, dispatcher: dispatcher, config: config, keys: keys, authPool: pool, metrics: metricsReg, accessLog: accessLog, stopChan: make(chan bool)}
+	gw.effective.Store(&config)
+	if nil != config.Admin {
+		if gw.adminServer, err = newAdminServer(gw); nil != err {
+			dispatcher.Stop()
+			pool.Stop()
+			if nil != accessLog {
+				accessLog.Close()
+			}
+			return nil, err
+		}
+	}
+	return gw, nil
+}
+
+// The config in effect, which has the routes of the last reload
+func (s *GwServer) currentConfig() *config.Config {
+	return s.effective.Load().(*config.Config)
+}
+
+// The gateway's metrics, ie for registering custom metrics when gogw is embedded
+func (s *GwServer) Metrics() *metrics.Registry {
+	return s.metrics
+}
+
+// gauges of the auth worker pool, read when the metrics are written
+func registerAuthPoolMetrics(reg *metrics.Registry, pool *auth.WorkerPool, workers int) {
+	reg.NewGaugeFunc("gogw_auth_workers", "Auth workers in the pool.", nil, func(emit func(float64, ...string)) {
+		emit(float64(workers))
+	})
+	reg.NewGaugeFunc("gogw_auth_queue_depth", "Requests waiting for an auth worker.", nil, func(emit func(float64, ...string)) {
+		emit(float64(pool.QueueLen()))
+	})
 }
 
 func (s *GwServer) Run() error {
-	stopChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	errChan := make(chan error)
 
-	signal.Notify(stopChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	// this calll blocks, so execute in a goroutine so we can handle shutdown
 	go func() {
@@ -93,19 +324,58 @@ func (s *GwServer) Run() error {
 		}
 	}()
 
-	select {
-	case err := <-errChan:
-		return err
-	case <-stopChan:
-		return s.Shutdown() // got the shutdown signal
+	if nil != s.adminServer {
+		log.Infof("admin listening on: %v", s.adminServer.Addr)
+		go func() {
+			if err := s.adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				errChan <- err
+			}
+		}()
+	}
+
+	// reload the config whenever the file changes
+	if s.config.Path != "" {
+		go s.watchConfig()
 	}
 
+	for {
+		select {
+		case err := <-errChan:
+			return err
+		case sig := <-sigChan:
+			if sig == syscall.SIGHUP {
+				log.Info("got SIGHUP, reloading config")
+				s.Reload()
+				continue
+			}
+			return s.Shutdown() // got the shutdown signal
+		}
+	}
 }
 
+// Gracefully stops the server. Only the first call shuts it down, later calls return the same result
 func (s *GwServer) Shutdown() error {
+	s.stopOnce.Do(func() { s.stopErr = s.shutdown() })
+	return s.stopErr
+}
+
+func (s *GwServer) shutdown() error {
 	log.Info("shutting down the server...")
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	close(s.stopChan)
+	s.dispatcher.Stop()
+	if keySet, ok := s.keys.(*auth.JWKSKeySet); ok {
+		keySet.Stop()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	err := s.httpServer.Shutdown(ctx)
+	s.authPool.Stop() // after in flight requests are done with it
+	if nil != s.adminServer {
+		s.adminServer.Shutdown(ctx)
+	}
+	if nil != s.accessLog {
+		s.accessLog.Close()
+	}
 	log.Info("server gracefully stopped")
 	return err
 }
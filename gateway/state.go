@@ -0,0 +1,35 @@
+package gateway
+
+import (
+	"context"
+	"github.com/seansitter/gogw/auth"
+	"net/http"
+	"time"
+)
+
+// keys for the values the gateway attaches to a request's context
+type contextKey int
+
+const (
+	pathParamsKey contextKey = iota
+	requestStateKey
+)
+
+// State gathered about a request as it moves through its route's stages
+type RequestState struct {
+	Endpoint        string        // name of the matched endpoint
+	RequestID       string        // the incoming X-Request-Id, or one generated for the request
+	Claims          auth.Claims   // claims of the authenticated principal, set by the auth stage
+	UpstreamLatency time.Duration // until the upstream's response headers arrived, set by the proxy stage
+}
+
+// Returns the state for the request, nil if it has not been dispatched
+func GetRequestState(r *http.Request) *RequestState {
+	state, _ := r.Context().Value(requestStateKey).(*RequestState)
+	return state
+}
+
+// attaches new state to the request context
+func withRequestState(r *http.Request, state *RequestState) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestStateKey, state))
+}
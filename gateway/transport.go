@@ -0,0 +1,259 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"github.com/seansitter/gogw/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/sony/gobreaker"
+	"net"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// A circuitbreaker is tied to a transport, which encapsulates the client/connection managment to and endpoint
+func newCircuitBreaker(name string, cbConfig *config.CircuitBreaker, m *gatewayMetrics) *gobreaker.CircuitBreaker {
+	if nil == cbConfig {
+		return nil
+	}
+
+	cbSettings := gobreaker.Settings{
+		Interval:    cbConfig.ClearFailureCountIntervalMs * time.Millisecond,
+		MaxRequests: cbConfig.MaxHalfOpenRequests,
+		Name:        fmt.Sprintf("crctbrkr-%v", name),
+		Timeout:     cbConfig.HalfOpenAfterMs * time.Millisecond,
+		ReadyToTrip: newTripPolicy(cbConfig),
+		OnStateChange: func(cbName string, from gobreaker.State, to gobreaker.State) {
+			log.Errorf("circuit breaker %v transitioned from: %v to: %v", cbName, from, to)
+			m.breakerStateChange(name, from, to)
+		},
+	}
+
+	return gobreaker.NewCircuitBreaker(cbSettings)
+}
+
+// Returns the function the circuit breaker calls on each failure to decide whether to open
+func newTripPolicy(cbConfig *config.CircuitBreaker) func(counts gobreaker.Counts) bool {
+	switch cbConfig.TripPolicy {
+	case config.TripFailureRatio:
+		return ratioTripPolicy(cbConfig.MinRequests, cbConfig.FailureRatio)
+	case config.TripSlowCallRatio:
+		// slow calls are reported to the breaker as failures, so the same ratio applies
+		return ratioTripPolicy(cbConfig.MinRequests, cbConfig.SlowCallRatio)
+	default:
+		failuresToOpen := uint32(cbConfig.FailuresToOpen)
+		return func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= failuresToOpen
+		}
+	}
+}
+
+// trips once minRequests have been seen in the current interval and the failure ratio reaches ratio
+func ratioTripPolicy(minRequests uint32, ratio float64) func(counts gobreaker.Counts) bool {
+	return func(counts gobreaker.Counts) bool {
+		if counts.Requests < minRequests || counts.Requests == 0 {
+			return false
+		}
+		return float64(counts.TotalFailures)/float64(counts.Requests) >= ratio
+	}
+}
+
+// A transport is a connection-managing client, its connections are counted in the metrics
+func newTransport(name string, proxyConfig config.Proxy, m *gatewayMetrics) http.RoundTripper {
+	dialer := &net.Dialer{
+		Timeout:   proxyConfig.DialTimeoutMs * time.Millisecond,
+		KeepAlive: proxyConfig.DialKeepAliveMs * time.Millisecond,
+		DualStack: true,
+	}
+
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           m.countingDialer(name, dialer.DialContext),
+		MaxIdleConns:          proxyConfig.MaxIdleConns,
+		MaxIdleConnsPerHost:   proxyConfig.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       proxyConfig.MaxConnsPerHost,
+		IdleConnTimeout:       proxyConfig.IdleConnTimeoutMs * time.Millisecond,
+		TLSHandshakeTimeout:   proxyConfig.TLSHandshakeTimeoutMs * time.Millisecond,
+		ExpectContinueTimeout: proxyConfig.ExpectContinueTimeoutMs * time.Millisecond,
+		ResponseHeaderTimeout: proxyConfig.ResponseHeaderTimeoutMs * time.Millisecond,
+		DisableCompression:    proxyConfig.CompressionDisabled(),
+		ForceAttemptHTTP2:     proxyConfig.HTTP2Enabled(), // a custom dialer otherwise disables http/2
+	}
+}
+
+// This struct ties together a circuit breaker and transport. It implements the RoundTrip interface,
+// which is the core interface of a transport. This allows it to be used in the go native
+// reverse proxy without any other modifications.
+type CbTransport struct {
+	Name        string
+	Transport   http.RoundTripper
+	SlowCall    time.Duration // when set, calls slower than this are counted as failures by the breaker
+	breaker     atomic.Value  // *gobreaker.CircuitBreaker, nil when not configured. replaced when it is reset
+	forcedOpen  int32         // atomic, set by an operator to reject every call
+	proxyConfig config.Proxy
+	cbConfig    *config.CircuitBreaker
+	metrics     *gatewayMetrics
+}
+
+// The counts of a transport's circuit breaker, as the breaker keeps them for its trip policy. They are those of
+// its current generation, which starts when the breaker changes state or clears its counts at the end of an interval
+type BreakerCounts struct {
+	Requests             uint32 `json:"requests"`
+	Successes            uint32 `json:"successes"`
+	Failures             uint32 `json:"failures"`
+	ConsecutiveSuccesses uint32 `json:"consecutiveSuccesses"`
+	ConsecutiveFailures  uint32 `json:"consecutiveFailures"`
+}
+
+// Returned for a 5xx response from the endpoint, which the circuit breaker counts as a failure
+type StatusError struct {
+	StatusCode int
+}
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("%v error for service endpoint", e.StatusCode)
+}
+
+// Returned when the circuit breaker rejects a request without sending it, ie when it is open
+type BreakerRejectedError struct {
+	Err error
+}
+
+func (e BreakerRejectedError) Error() string {
+	return e.Err.Error()
+}
+
+// returned to the circuit breaker for a call which succeeded, but too slowly
+var errSlowCall = errors.New("slow call to service endpoint")
+
+// returned for calls rejected while the breaker is forced open
+var errForcedOpen = errors.New("circuit breaker is forced open")
+
+// Instantiates a CbTransport
+func newCbTransport(name string, proxyConfig config.Proxy, cbConfig *config.CircuitBreaker, m *gatewayMetrics) *CbTransport {
+	var slowCall time.Duration
+	if nil != cbConfig && cbConfig.TripPolicy == config.TripSlowCallRatio {
+		slowCall = cbConfig.SlowCallMs * time.Millisecond
+	}
+
+	transport := &CbTransport{
+		Name:        name,
+		Transport:   newTransport(name, proxyConfig, m),
+		SlowCall:    slowCall,
+		proxyConfig: proxyConfig,
+		cbConfig:    cbConfig,
+		metrics:     m,
+	}
+	transport.breaker.Store(newCircuitBreaker(name, cbConfig, m))
+	return transport
+}
+
+// The transport's circuit breaker, nil when none is configured
+func (transport *CbTransport) CircuitBreaker() *gobreaker.CircuitBreaker {
+	return transport.breaker.Load().(*gobreaker.CircuitBreaker)
+}
+
+// The state of the breaker, which is open while it is forced open. Closed when there is no breaker
+func (transport *CbTransport) BreakerState() gobreaker.State {
+	if transport.ForcedOpen() {
+		return gobreaker.StateOpen
+	}
+	if cb := transport.CircuitBreaker(); nil != cb {
+		return cb.State()
+	}
+	return gobreaker.StateClosed
+}
+
+func (transport *CbTransport) ForcedOpen() bool {
+	return atomic.LoadInt32(&transport.forcedOpen) == 1
+}
+
+// Rejects every call through the transport until the breaker is reset, ie to take a bad upstream out by hand
+func (transport *CbTransport) ForceOpen() {
+	from := transport.BreakerState()
+	atomic.StoreInt32(&transport.forcedOpen, 1)
+	log.Warnf("circuit breaker for transport: %v was forced open", transport.Name)
+	if from != gobreaker.StateOpen {
+		transport.metrics.breakerStateChange(transport.Name, from, gobreaker.StateOpen)
+	}
+}
+
+// Closes the breaker and clears any forced open state. The new breaker's counts start from zero
+func (transport *CbTransport) ResetBreaker() {
+	from := transport.BreakerState()
+	transport.breaker.Store(newCircuitBreaker(transport.Name, transport.cbConfig, transport.metrics))
+	atomic.StoreInt32(&transport.forcedOpen, 0)
+
+	log.Warnf("circuit breaker for transport: %v was reset", transport.Name)
+	if from != gobreaker.StateClosed {
+		transport.metrics.breakerStateChange(transport.Name, from, gobreaker.StateClosed)
+	}
+}
+
+// The breaker's counts, all zero when there is no breaker
+func (transport *CbTransport) Counts() BreakerCounts {
+	cb := transport.CircuitBreaker()
+	if nil == cb {
+		return BreakerCounts{}
+	}
+
+	counts := cb.Counts()
+	return BreakerCounts{
+		Requests:             counts.Requests,
+		Successes:            counts.TotalSuccesses,
+		Failures:             counts.TotalFailures,
+		ConsecutiveSuccesses: counts.ConsecutiveSuccesses,
+		ConsecutiveFailures:  counts.ConsecutiveFailures,
+	}
+}
+
+// Whether the transport was built from the given settings, in which case it can be reused across a reload
+func (transport *CbTransport) configuredWith(proxyConfig config.Proxy, cbConfig *config.CircuitBreaker) bool {
+	return reflect.DeepEqual(transport.proxyConfig, proxyConfig) && reflect.DeepEqual(transport.cbConfig, cbConfig)
+}
+
+// RoundTrip interface is implemented by CbTransport so that we can have a transport with a circuitbreaker
+func (transport *CbTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	var resp interface{}
+	var err error
+
+	if transport.ForcedOpen() {
+		transport.metrics.breakerRejected(transport.Name)
+		return nil, BreakerRejectedError{errForcedOpen}
+	}
+
+	if cb := transport.CircuitBreaker(); nil == cb {
+		resp, err = transport.Transport.RoundTrip(request)
+	} else {
+		sent := false
+		resp, err = cb.Execute(func() (interface{}, error) {
+			sent = true
+			start := time.Now()
+			r, e := transport.Transport.RoundTrip(request)
+			if nil != r && r.StatusCode >= 500 && r.StatusCode < 600 {
+				r.Body.Close()
+				return nil, StatusError{r.StatusCode}
+			}
+			if nil == e && transport.SlowCall > 0 && time.Since(start) > transport.SlowCall {
+				return r, errSlowCall
+			}
+			return r, e
+		})
+		// the breaker has counted the slow call, but the response is still good
+		if err == errSlowCall {
+			err = nil
+		}
+		if !sent {
+			transport.metrics.breakerRejected(transport.Name)
+			err = BreakerRejectedError{err}
+		}
+	}
+
+	if nil == resp {
+		return nil, err
+	}
+
+	return resp.(*http.Response), err
+}
@@ -0,0 +1,208 @@
+package gateway
+
+import (
+	"errors"
+	"github.com/seansitter/gogw/config"
+	"github.com/seansitter/gogw/metrics"
+	"github.com/sony/gobreaker"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A RoundTripper which answers each call with the next of its responses, the last is repeated
+type stubRoundTripper struct {
+	responses []stubResponse
+	calls     int
+}
+
+type stubResponse struct {
+	status int
+	err    error
+	delay  time.Duration
+}
+
+func (stub *stubRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	i := stub.calls
+	if i >= len(stub.responses) {
+		i = len(stub.responses) - 1
+	}
+	stub.calls++
+
+	resp := stub.responses[i]
+	time.Sleep(resp.delay)
+	if nil != resp.err {
+		return nil, resp.err
+	}
+	return &http.Response{
+		StatusCode: resp.status,
+		Body:       ioutil.NopCloser(strings.NewReader("body")),
+		Request:    r,
+	}, nil
+}
+
+func newTestTransport(cbConfig *config.CircuitBreaker, responses ...stubResponse) *CbTransport {
+	m := newGatewayMetrics(metrics.NewRegistry(), new(Dispatcher))
+	transport := newCbTransport("test", config.Proxy{}, cbConfig, m)
+	transport.Transport = &stubRoundTripper{responses: responses}
+	return transport
+}
+
+func roundTrip(t *testing.T, transport *CbTransport) (*http.Response, error) {
+	r, err := http.NewRequest(http.MethodGet, "http://upstream/", nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return transport.RoundTrip(r)
+}
+
+func TestConsecutiveFailuresTrips(t *testing.T) {
+	transport := newTestTransport(&config.CircuitBreaker{
+		TripPolicy:      config.TripConsecutiveFailures,
+		FailuresToOpen:  3,
+		HalfOpenAfterMs: 60000,
+	}, stubResponse{err: errors.New("connection refused")})
+
+	for i := 0; i < 2; i++ {
+		roundTrip(t, transport)
+		if state := transport.BreakerState(); state != gobreaker.StateClosed {
+			t.Fatalf("breaker is %v after %v failures, expected it closed", state, i+1)
+		}
+	}
+
+	roundTrip(t, transport)
+	if state := transport.BreakerState(); state != gobreaker.StateOpen {
+		t.Fatalf("breaker is %v after 3 failures, expected it open", state)
+	}
+
+	calls := transport.Transport.(*stubRoundTripper).calls
+	_, err := roundTrip(t, transport)
+	if _, ok := err.(BreakerRejectedError); !ok {
+		t.Errorf("expected a BreakerRejectedError from the open breaker, got: %v", err)
+	}
+	if transport.Transport.(*stubRoundTripper).calls != calls {
+		t.Error("the open breaker sent the call")
+	}
+}
+
+func TestFailureRatioTripsAfterMinRequests(t *testing.T) {
+	transport := newTestTransport(&config.CircuitBreaker{
+		TripPolicy:      config.TripFailureRatio,
+		MinRequests:     4,
+		FailureRatio:    0.5,
+		HalfOpenAfterMs: 60000,
+	}, stubResponse{err: errors.New("connection refused")})
+
+	// every call fails, but the ratio isn't considered until there have been enough of them
+	for i := 0; i < 3; i++ {
+		roundTrip(t, transport)
+		if state := transport.BreakerState(); state != gobreaker.StateClosed {
+			t.Fatalf("breaker is %v after %v requests, expected it closed until minRequests", state, i+1)
+		}
+	}
+
+	roundTrip(t, transport)
+	if state := transport.BreakerState(); state != gobreaker.StateOpen {
+		t.Fatalf("breaker is %v after minRequests failures, expected it open", state)
+	}
+}
+
+func TestFailureRatioStaysClosedBelowRatio(t *testing.T) {
+	transport := newTestTransport(&config.CircuitBreaker{
+		TripPolicy:      config.TripFailureRatio,
+		MinRequests:     4,
+		FailureRatio:    0.5,
+		HalfOpenAfterMs: 60000,
+	},
+		stubResponse{status: 200},
+		stubResponse{status: 200},
+		stubResponse{status: 200},
+		stubResponse{err: errors.New("connection refused")},
+		stubResponse{status: 200})
+
+	for i := 0; i < 6; i++ {
+		roundTrip(t, transport)
+	}
+	if state := transport.BreakerState(); state != gobreaker.StateClosed {
+		t.Fatalf("breaker is %v with 1 failure in 6 requests, expected it closed", state)
+	}
+}
+
+func TestSlowCallRatioTripsAndReturnsResponse(t *testing.T) {
+	transport := newTestTransport(&config.CircuitBreaker{
+		TripPolicy:      config.TripSlowCallRatio,
+		MinRequests:     2,
+		SlowCallMs:      5,
+		SlowCallRatio:   1,
+		HalfOpenAfterMs: 60000,
+	}, stubResponse{status: 200, delay: 20 * time.Millisecond})
+
+	// the slow call is counted against the breaker, but its response still goes to the caller
+	resp, err := roundTrip(t, transport)
+	if nil != err {
+		t.Fatalf("expected the slow call's response, got error: %v", err)
+	}
+	if nil == resp || resp.StatusCode != 200 {
+		t.Fatalf("expected the slow call's 200 response, got: %v", resp)
+	}
+	if state := transport.BreakerState(); state != gobreaker.StateClosed {
+		t.Fatalf("breaker is %v before minRequests, expected it closed", state)
+	}
+
+	resp, err = roundTrip(t, transport)
+	if nil != err || nil == resp {
+		t.Fatalf("expected the slow call's response, got error: %v", err)
+	}
+	if state := transport.BreakerState(); state != gobreaker.StateOpen {
+		t.Fatalf("breaker is %v after 2 slow calls, expected it open", state)
+	}
+}
+
+func TestServerErrorCountsAsFailure(t *testing.T) {
+	transport := newTestTransport(&config.CircuitBreaker{
+		TripPolicy:      config.TripConsecutiveFailures,
+		FailuresToOpen:  2,
+		HalfOpenAfterMs: 60000,
+	}, stubResponse{status: 503})
+
+	resp, err := roundTrip(t, transport)
+	if statusErr, ok := err.(StatusError); !ok || statusErr.StatusCode != 503 {
+		t.Fatalf("expected a StatusError for the 503, got: %v", err)
+	}
+	if nil != resp {
+		t.Error("expected no response with the StatusError")
+	}
+
+	roundTrip(t, transport)
+	if state := transport.BreakerState(); state != gobreaker.StateOpen {
+		t.Fatalf("breaker is %v after 2 5xx responses, expected it open", state)
+	}
+}
+
+func TestCountsAreTheBreakersGeneration(t *testing.T) {
+	transport := newTestTransport(&config.CircuitBreaker{
+		TripPolicy:      config.TripConsecutiveFailures,
+		FailuresToOpen:  2,
+		HalfOpenAfterMs: 60000,
+	}, stubResponse{status: http.StatusOK}, stubResponse{err: errors.New("connection refused")})
+
+	roundTrip(t, transport)
+	roundTrip(t, transport)
+	counts := transport.Counts()
+	if counts.Requests != 2 || counts.Successes != 1 || counts.Failures != 1 || counts.ConsecutiveFailures != 1 {
+		t.Fatalf("expected the breaker's counts, got: %+v", counts)
+	}
+
+	// the breaker opens, starting a new generation which the rejected call isn't counted in
+	roundTrip(t, transport)
+	roundTrip(t, transport)
+	if counts := transport.Counts(); counts != (BreakerCounts{}) {
+		t.Errorf("expected the counts to start over when the breaker opened, got: %+v", counts)
+	}
+
+	if counts := newTestTransport(nil, stubResponse{status: http.StatusOK}).Counts(); counts != (BreakerCounts{}) {
+		t.Errorf("expected no counts without a breaker, got: %+v", counts)
+	}
+}
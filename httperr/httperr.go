@@ -16,4 +16,7 @@ func (e Error) String() string {
 var UnAuthorized = Error{Code: 401, Message: "unauthorized"}
 var Forbidden = Error{Code: 403, Message: "forbidden"}
 var NotFound = Error{Code: 404, Message: "not found"}
+var TooManyRequests = Error{Code: 429, Message: "too many requests"} // over a rate limit
 var TooBusy = Error{Code: 503, Message: "overloaded"}
+var Unavailable = Error{Code: 503, Message: "service unavailable"}
+var ClientClosedRequest = Error{Code: 499, Message: "client closed request"} // the client went away before a response
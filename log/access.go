@@ -0,0 +1,176 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// access log formats
+const (
+	AccessLogJSON     = "json"
+	AccessLogCombined = "combined" // combined log format, followed by the endpoint, request id and latencies
+)
+
+// One line of the access log, for a request handled by the gateway
+type AccessEntry struct {
+	Time            time.Time // when the request was received
+	Method          string
+	Path            string // without the query, which may carry credentials (ie an api key)
+	Proto           string
+	Endpoint        string // empty when no route matched
+	Status          int
+	Bytes           int64         // of the response body
+	UpstreamLatency time.Duration // until the upstream's response headers arrived, zero when the request wasn't proxied
+	Latency         time.Duration // total time to handle the request
+	ClientIP        string
+	Subject         string // the sub claim of the authenticated principal
+	RequestID       string
+	Referer         string
+	UserAgent       string
+}
+
+// Writes one line per request to its own file, in json or the combined log format. Requests may be sampled,
+// and paths excluded (ie health checks). Server errors are logged regardless of sampling
+type AccessLogger struct {
+	format       string
+	sampleRate   float64
+	excludePaths []string
+	w            io.Writer
+	closer       io.Closer // the log file, nil for stdout
+	lock         sync.Mutex
+}
+
+// Instantiates an access logger writing to the file, or stdout when it is empty
+func NewAccessLogger(format string, file string, sampleRate float64, excludePaths []string) (*AccessLogger, error) {
+	switch format {
+	case AccessLogJSON, AccessLogCombined:
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown access log format: '%v'", format))
+	}
+
+	w, err := openWriter(file)
+	if nil != err {
+		return nil, err
+	}
+
+	logger := &AccessLogger{format: format, sampleRate: sampleRate, excludePaths: excludePaths, w: w}
+	if file != "" {
+		logger.closer = w.(io.Closer)
+	}
+	return logger, nil
+}
+
+// whether requests to the path are left out of the log
+func (logger *AccessLogger) excluded(path string) bool {
+	for _, prefix := range logger.excludePaths {
+		if path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Logs the request, subject to sampling and the excluded paths
+func (logger *AccessLogger) Log(entry AccessEntry) {
+	if logger.excluded(entry.Path) {
+		return
+	}
+	if entry.Status < 500 && logger.sampleRate < 1 && rand.Float64() >= logger.sampleRate {
+		return
+	}
+
+	var line []byte
+	if logger.format == AccessLogCombined {
+		line = []byte(combinedLine(entry))
+	} else {
+		line = jsonLine(entry)
+	}
+
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	logger.w.Write(line)
+}
+
+// Closes the log file, when the logger has one
+func (logger *AccessLogger) Close() error {
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+
+	if nil == logger.closer {
+		return nil
+	}
+	return logger.closer.Close()
+}
+
+// the json form of an entry, in field order
+type jsonEntry struct {
+	Time            string  `json:"time"`
+	Method          string  `json:"method"`
+	Path            string  `json:"path"`
+	Proto           string  `json:"proto"`
+	Endpoint        string  `json:"endpoint"`
+	Status          int     `json:"status"`
+	Bytes           int64   `json:"bytes"`
+	UpstreamLatency float64 `json:"upstream_latency_ms"`
+	Latency         float64 `json:"latency_ms"`
+	ClientIP        string  `json:"client_ip"`
+	Subject         string  `json:"subject,omitempty"`
+	RequestID       string  `json:"request_id,omitempty"`
+	Referer         string  `json:"referer,omitempty"`
+	UserAgent       string  `json:"user_agent,omitempty"`
+}
+
+func jsonLine(entry AccessEntry) []byte {
+	line, _ := json.Marshal(jsonEntry{
+		Time:            entry.Time.Format(time.RFC3339Nano),
+		Method:          entry.Method,
+		Path:            entry.Path,
+		Proto:           entry.Proto,
+		Endpoint:        entry.Endpoint,
+		Status:          entry.Status,
+		Bytes:           entry.Bytes,
+		UpstreamLatency: ms(entry.UpstreamLatency),
+		Latency:         ms(entry.Latency),
+		ClientIP:        entry.ClientIP,
+		Subject:         entry.Subject,
+		RequestID:       entry.RequestID,
+		Referer:         entry.Referer,
+		UserAgent:       entry.UserAgent,
+	})
+	return append(line, '\n')
+}
+
+// host ident authuser [date] "request" status bytes "referer" "user-agent", then the gateway's own fields:
+// "endpoint" "request id" latency_ms upstream_latency_ms
+func combinedLine(entry AccessEntry) string {
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d %q %q %q %q %.3f %.3f\n",
+		orDash(entry.ClientIP),
+		orDash(entry.Subject),
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method, entry.Path, entry.Proto,
+		entry.Status,
+		entry.Bytes,
+		orDash(entry.Referer),
+		orDash(entry.UserAgent),
+		orDash(entry.Endpoint),
+		orDash(entry.RequestID),
+		ms(entry.Latency),
+		ms(entry.UpstreamLatency))
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,24 @@
+package log
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+)
+
+// the field a request's id is logged as
+const RequestIDField = "request_id"
+
+type loggerKey struct{}
+
+// Returns a context carrying the request's logger, ie one with its request id
+func WithLogger(ctx context.Context, logger *log.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// The request's logger carried by the context, the standard logger when there is none
+func FromContext(ctx context.Context) *log.Entry {
+	if logger, ok := ctx.Value(loggerKey{}).(*log.Entry); ok {
+		return logger
+	}
+	return log.NewEntry(log.StandardLogger())
+}
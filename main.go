@@ -14,6 +14,7 @@ import (
 const DefaultEnv = "local"
 
 var env string
+var configPath string
 
 func main() {
 	loginit.Init("debug", "") // initial logger is trace to stdout, until we read the config
@@ -38,7 +39,10 @@ func initLogger(loggerConfig *config.Logger) {
 func initOptions() {
 	// get the env from environment variable or commandline arg
 	pEnv := flag.String("env", "", "the environment")
+	pConfig := flag.String("config", "", "path to the config file, overrides the embedded config for the env")
+	flag.Parse()
 	env = *pEnv
+	configPath = *pConfig
 
 	if "" == env && "" != os.Getenv("GWENV") {
 		env = os.Getenv("GWENV")
@@ -47,12 +51,24 @@ func initOptions() {
 		env = DefaultEnv
 	}
 
+	// get the config path from environment variable or commandline arg
+	if "" == configPath && "" != os.Getenv("GWCONFIG") {
+		configPath = os.Getenv("GWCONFIG")
+	}
+
 	log.Infof("running in env: %v", env)
 }
 
 func initConfig() *config.Config {
-	ctnt := res.MustAsset(fmt.Sprintf("assets/config-%s.yml", env))
-	c, err := config.Parse(ctnt)
+	var c *config.Config
+	var err error
+
+	if "" != configPath {
+		log.Infof("loading config from: %v", configPath)
+		c, err = config.ParseFile(configPath)
+	} else {
+		c, err = config.Parse(res.MustAsset(fmt.Sprintf("assets/config-%s.yml", env)))
+	}
 	if nil != err {
 		log.Errorf("failed to load config: %v", err)
 		os.Exit(1)
@@ -0,0 +1,327 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// the latency buckets of a request histogram, in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A registry of metrics, which are written in the prometheus text exposition format
+type Registry struct {
+	metrics []metric
+	names   map[string]bool
+	lock    sync.Mutex
+}
+
+// a metric family, which writes its help, type and samples
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (reg *Registry) register(name string, m metric) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+
+	if reg.names[name] {
+		panic(fmt.Sprintf("metric: %v is already registered", name))
+	}
+	reg.names[name] = true
+	reg.metrics = append(reg.metrics, m)
+}
+
+// Writes every metric in the text exposition format
+func (reg *Registry) Write(w io.Writer) error {
+	reg.lock.Lock()
+	metrics := append([]metric(nil), reg.metrics...)
+	reg.lock.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// A handler which serves the metrics, ie on /metrics
+func (reg *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		reg.Write(w)
+	})
+}
+
+// the name, help and label names of a metric family
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, strings.Replace(d.help, "\n", " ", -1), d.name, d.typ)
+}
+
+// writes a sample, with the label values and any extra label (ie le)
+func (d *desc) writeSample(w *bufio.Writer, suffix string, labelValues []string, extraName string, extraValue string, value float64) {
+	w.WriteString(d.name)
+	w.WriteString(suffix)
+	if len(d.labels) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, l := range d.labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", l, escapeLabel(labelValues[i]))
+		}
+		if extraName != "" {
+			if len(d.labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extraName, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// a float64 which is updated atomically
+type atomicFloat struct {
+	bits uint64
+}
+
+func (f *atomicFloat) Add(v float64) {
+	for {
+		old := atomic.LoadUint64(&f.bits)
+		if atomic.CompareAndSwapUint64(&f.bits, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) Set(v float64) {
+	atomic.StoreUint64(&f.bits, math.Float64bits(v))
+}
+
+func (f *atomicFloat) Load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&f.bits))
+}
+
+// the series of a metric family, by label values
+type seriesSet struct {
+	desc
+	series map[string]interface{}
+	values map[string][]string // the label values of each series
+	lock   sync.RWMutex
+}
+
+func newSeriesSet(name string, help string, typ string, labels []string) seriesSet {
+	return seriesSet{desc: desc{name, help, typ, labels}, series: make(map[string]interface{}), values: make(map[string][]string)}
+}
+
+// returns the series for the label values, created by newSeries when it doesn't exist
+func (s *seriesSet) get(labelValues []string, newSeries func() interface{}) interface{} {
+	if len(labelValues) != len(s.labels) {
+		panic(fmt.Sprintf("metric: %v has %v labels, got %v values", s.name, len(s.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	s.lock.RLock()
+	series, ok := s.series[key]
+	s.lock.RUnlock()
+	if ok {
+		return series
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if series, ok = s.series[key]; !ok {
+		series = newSeries()
+		s.series[key] = series
+		s.values[key] = append([]string(nil), labelValues...)
+	}
+	return series
+}
+
+// calls f for each series, in order of their label values
+func (s *seriesSet) each(f func(labelValues []string, series interface{})) {
+	s.lock.RLock()
+	keys := make([]string, 0, len(s.series))
+	for key := range s.series {
+		keys = append(keys, key)
+	}
+	s.lock.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s.lock.RLock()
+		series, values := s.series[key], s.values[key]
+		s.lock.RUnlock()
+		f(values, series)
+	}
+}
+
+// A counter, with a series for each set of label values
+type Counter struct {
+	seriesSet
+}
+
+func (reg *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{newSeriesSet(name, help, "counter", labels)}
+	reg.register(name, c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.get(labelValues, func() interface{} { return new(atomicFloat) }).(*atomicFloat).Add(v)
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.each(func(labelValues []string, series interface{}) {
+		c.writeSample(w, "", labelValues, "", "", series.(*atomicFloat).Load())
+	})
+}
+
+// A gauge, with a series for each set of label values
+type Gauge struct {
+	seriesSet
+}
+
+func (reg *Registry) NewGauge(name string, help string, labels ...string) *Gauge {
+	g := &Gauge{newSeriesSet(name, help, "gauge", labels)}
+	reg.register(name, g)
+	return g
+}
+
+func (g *Gauge) value(labelValues []string) *atomicFloat {
+	return g.get(labelValues, func() interface{} { return new(atomicFloat) }).(*atomicFloat)
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.value(labelValues).Set(v)
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.value(labelValues).Add(v)
+}
+
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	g.each(func(labelValues []string, series interface{}) {
+		g.writeSample(w, "", labelValues, "", "", series.(*atomicFloat).Load())
+	})
+}
+
+// A histogram of observations, ie latencies, with a series for each set of label values
+type Histogram struct {
+	seriesSet
+	buckets []float64 // upper bounds, ascending
+}
+
+// The count is derived from the buckets when the series is written, rather than kept on its own, so that the
+// +Inf bucket and the count always agree with the buckets below them, however they race with observations
+type histogramSeries struct {
+	counts []uint64 // atomic, per bucket and not cumulative. the last is for observations above every bucket
+	sum    atomicFloat
+}
+
+func (reg *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{newSeriesSet(name, help, "histogram", labels), append([]float64(nil), buckets...)}
+	sort.Float64s(h.buckets)
+	reg.register(name, h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	series := h.get(labelValues, func() interface{} {
+		return &histogramSeries{counts: make([]uint64, len(h.buckets)+1)}
+	}).(*histogramSeries)
+
+	atomic.AddUint64(&series.counts[sort.SearchFloat64s(h.buckets, v)], 1)
+	series.sum.Add(v)
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	h.each(func(labelValues []string, s interface{}) {
+		series := s.(*histogramSeries)
+		// each bucket is read once, so the cumulative counts can't go down even while observations race in
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += atomic.LoadUint64(&series.counts[i])
+			h.writeSample(w, "_bucket", labelValues, "le", formatFloat(upper), float64(cumulative))
+		}
+		count := cumulative + atomic.LoadUint64(&series.counts[len(h.buckets)])
+		h.writeSample(w, "_bucket", labelValues, "le", "+Inf", float64(count))
+		h.writeSample(w, "_sum", labelValues, "", "", series.sum.Load())
+		h.writeSample(w, "_count", labelValues, "", "", float64(count))
+	})
+}
+
+// A metric whose samples are collected when the metrics are written, ie from state held elsewhere
+type collectedMetric struct {
+	desc
+	collect func(emit func(value float64, labelValues ...string))
+}
+
+// Registers a gauge collected when the metrics are written. collect emits a sample for each set of label values
+func (reg *Registry) NewGaugeFunc(name string, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) {
+	reg.register(name, &collectedMetric{desc{name, help, "gauge", labels}, collect})
+}
+
+// Registers a counter collected when the metrics are written. collect emits a sample for each set of label values
+func (reg *Registry) NewCounterFunc(name string, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) {
+	reg.register(name, &collectedMetric{desc{name, help, "counter", labels}, collect})
+}
+
+func (m *collectedMetric) write(w *bufio.Writer) {
+	m.writeHeader(w)
+	m.collect(func(value float64, labelValues ...string) {
+		if len(labelValues) == len(m.labels) {
+			m.writeSample(w, "", labelValues, "", "", value)
+		}
+	})
+}
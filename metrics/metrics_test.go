@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// the cumulative bucket counts and the count of the test histogram, from a single write of the registry
+func writeHistogram(t *testing.T, reg *Registry) ([]float64, float64) {
+	var buf bytes.Buffer
+	if err := reg.Write(&buf); nil != err {
+		t.Fatal(err)
+	}
+
+	var buckets []float64
+	var count float64
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if !strings.HasPrefix(line, "test_seconds_bucket") && !strings.HasPrefix(line, "test_seconds_count") {
+			continue
+		}
+		fields := strings.Fields(line)
+		v, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+		if nil != err {
+			t.Fatalf("bad sample: %v", line)
+		}
+		if strings.HasPrefix(line, "test_seconds_bucket") {
+			buckets = append(buckets, v)
+		} else {
+			count = v
+		}
+	}
+	return buckets, count
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	reg := NewRegistry()
+	h := reg.NewHistogram("test_seconds", "test", []float64{0.1, 1})
+
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5) // above every bucket
+
+	buckets, count := writeHistogram(t, reg)
+	expected := []float64{1, 2, 3}
+	if len(buckets) != len(expected) {
+		t.Fatalf("expected buckets: %v, got: %v", expected, buckets)
+	}
+	for i := range expected {
+		if buckets[i] != expected[i] {
+			t.Errorf("expected buckets: %v, got: %v", expected, buckets)
+		}
+	}
+	if count != 3 {
+		t.Errorf("expected a count of 3, got: %v", count)
+	}
+}
+
+func TestHistogramConsistentWhileObserving(t *testing.T) {
+	reg := NewRegistry()
+	h := reg.NewHistogram("test_seconds", "test", []float64{0.1, 1})
+
+	var wg sync.WaitGroup
+	stop := make(chan bool)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					h.Observe(0.05)
+					h.Observe(5)
+				}
+			}
+		}()
+	}
+
+	// the cumulative buckets never go down, and +Inf is always the count
+	for i := 0; i < 200; i++ {
+		buckets, count := writeHistogram(t, reg)
+		for j := 1; j < len(buckets); j++ {
+			if buckets[j] < buckets[j-1] {
+				t.Fatalf("cumulative buckets went down: %v", buckets)
+			}
+		}
+		if len(buckets) > 0 && buckets[len(buckets)-1] != count {
+			t.Fatalf("+Inf bucket: %v is not the count: %v", buckets[len(buckets)-1], count)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}